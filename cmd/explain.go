@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/monitor"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// runExplain prints every gate the monitor would consider for a single node
+func runExplain(args []string) {
+	var namespace string
+	var output string
+	var deleteNodeAfter time.Duration
+	var requireStorage bool
+	var minLeaseAge time.Duration
+	var maxUnreachable int
+	var quorum string
+	var topologyLabels string
+
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s explain [flags] <node>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&namespace, "namespace", getReportNamespace(), "namespace holding the reports (env - REPORT_NAMESPACE or NAMESPACE)")
+	fs.StringVar(&output, "o", "table", "output format (table|json)")
+	fs.DurationVar(&deleteNodeAfter, "delete-node-after", 0, "explain node deletion as configured for the monitor")
+	fs.DurationVar(&minLeaseAge, "min-lease-age", defaultMinLeaseAge, "explain the node lease gate as configured for the monitor")
+	fs.BoolVar(&requireStorage, "require-storage-unreachable", false, "explain the storage network gate as configured for the monitor")
+	fs.IntVar(&maxUnreachable, "max-unreachable-nodes", 0, "explain the circuit breaker as configured for the monitor, 0 when disabled")
+	fs.StringVar(&quorum, "quorum", kubeutils.QuorumAll, "explain the quorum as configured for the monitor all|cross-domain")
+	fs.StringVar(&topologyLabels, "topology-labels", strings.Join(kubeutils.DefaultTopologyLabels, ","), "explain failure domains as configured for the monitor")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	nodeName := fs.Arg(0)
+	if namespace == "" {
+		klog.Fatal("Expecting -namespace, REPORT_NAMESPACE or NAMESPACE to be set")
+	}
+	cfg, err := kubeutils.BuildConfig()
+	if err != nil {
+		klog.Fatalf("error getting kubernetes config: %s", err)
+	}
+	client := clientset.NewForConfigOrDie(cfg)
+
+	reports, err := kubeutils.GetReports(client, namespace)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	allNodes, err := client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Fatalf("can't list nodes: %s", err)
+	}
+	var node *v1.Node
+	for i := range allNodes.Items {
+		if allNodes.Items[i].Name == nodeName {
+			node = &allNodes.Items[i]
+		}
+	}
+	if node == nil {
+		klog.Fatalf("node %s not found", nodeName)
+	}
+	leases, err := kubeutils.GetNodeLeases(client)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	now := time.Now()
+	policy := monitor.ReapPolicy{
+		DeleteNodeAfter:           deleteNodeAfter,
+		MinLeaseAge:               minLeaseAge,
+		RequireStorageUnreachable: requireStorage,
+		MaxUnreachableNodes:       maxUnreachable,
+		Consensus:                 consensusPolicy(quorum, topologyLabels),
+	}
+	consensus := kubeutils.EvaluateConsensus(allNodes.Items, reports, policy.Consensus, now)
+	// Explain as an enforcing monitor would see it
+	m := monitor.New(true, false, namespace, "", policy)
+	d := m.Explain(node, consensus, reports, leases, now)
+
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(d); err != nil {
+			klog.Fatalf("error encoding decision: %s", err)
+		}
+	case "table":
+		fmt.Printf("Node:     %s\n", d.Node)
+		fmt.Printf("Decision: %s\n\n", d.Outcome)
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "GATE\tPASSED\tDETAIL")
+		for _, g := range d.Gates {
+			fmt.Fprintf(w, "%s\t%t\t%s\n", g.Name, g.Passed, g.Detail)
+		}
+		w.Flush()
+	default:
+		klog.Fatalf("unknown output format %s", output)
+	}
+}
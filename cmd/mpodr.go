@@ -4,10 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"strconv"
 
+	"github.com/appvia/metal-pod-reaper/pkg/audit"
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/monitor"
 	"github.com/appvia/metal-pod-reaper/pkg/mpodr"
+	"github.com/appvia/metal-pod-reaper/pkg/reaper"
 	"github.com/appvia/metal-pod-reaper/pkg/version"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 )
 
@@ -16,45 +20,111 @@ func Execute() {
 
 	klog.InitFlags(nil)
 
-	var dryRun bool
-	var reap bool
-	var ver bool
-	var namespace string
-	var hostIP string
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status":
+			runStatus(os.Args[2:])
+			return
+		case "explain":
+			runExplain(os.Args[2:])
+			return
+		case "reap":
+			runReap(os.Args[2:])
+			return
+		case "simulate":
+			runSimulate(os.Args[2:])
+			return
+		case "snapshot":
+			runSnapshot(os.Args[2:])
+			return
+		}
+	}
 
-	flag.BoolVar(&dryRun, "dry-run", true, "only report on potential changes (env - DRY_RUN)")
-	flag.BoolVar(&reap, "no-reap", true, "do not run the reap facility")
-	flag.StringVar(&namespace, "namespace", "", "namespace for the master leaselock object (env - NAMESPACE)")
-	flag.StringVar(&hostIP, "host-ip", "", "specify the host ip (env - HOST_IP)")
-	flag.BoolVar(&ver, "version", false, "display the version")
-	flag.Parse()
+	o := &options{}
+	o.addFlags(flag.CommandLine)
+	if err := o.parse(flag.CommandLine, os.Args[1:], os.Getenv); err != nil {
+		klog.Fatal(err)
+	}
 
-	if ver {
+	if o.version {
 		fmt.Printf("%+v\n", version.Get())
 		os.Exit(0)
 	}
-	if namespace == "" {
-		namespace = os.Getenv("NAMESPACE")
-		if namespace == "" {
-			// TODO get from API or /run/secrets/kubernetes.io/serviceaccount/namespace
-			klog.Fatal("Expecting NAMESPACE to be set")
-		}
+	if err := discover(o); err != nil {
+		klog.Fatal(err)
 	}
-	if hostIP == "" {
-		hostIP = os.Getenv("HOST_IP")
-		if hostIP == "" {
-			klog.Fatal("Expecting HOST_IP to be set")
-		}
+	reap, dryRun, err := mpodr.ParseMode(o.mode)
+	if err != nil {
+		klog.Fatal(err)
 	}
-	dryRunStr := os.Getenv("DRY_RUN")
-	if len(dryRunStr) > 0 {
-		if b, err := strconv.ParseBool(dryRunStr); err != nil {
-			klog.Fatalf("Expecting bool in DRY_RUN not %s", dryRunStr)
-		} else {
-			dryRun = b
-		}
+	klog.Infof("running as %s in mode %s (reap=%t dry-run=%t)", o.role, o.mode, reap, dryRun)
+	klog.Infof("running on node %s (%s) in namespace %s with reports in %s", o.nodeName, o.hostIP, o.namespace, o.reportNamespace)
+	klog.Infof("options: %s", o)
+	policy := monitor.ReapPolicy{
+		DeleteNodeAfter: o.deleteNodeAfter,
+		Pods: reaper.Policy{
+			Evict:           o.evict,
+			EvictionTimeout: o.evictionTimeout,
+		},
+		MinLeaseAge:               o.minLeaseAge,
+		RequireStorageUnreachable: o.requireStorage,
+		ReportRetention:           o.reportRetention,
+		Consensus:                 consensusPolicy(o.quorum, o.topologyLabels),
+		MaxUnreachableNodes:       o.maxUnreachable,
+		MaxAPIServerLatency:       o.maxLatency,
+	}
+	o.probePolicy.MinLeaseAge = o.minLeaseAge
+	o.probePolicy.TopologyLabels = policy.Consensus.TopologyLabels
+	hostname, _ := os.Hostname()
+	auditLog, err := audit.New(o.auditLog, o.auditWebhook, audit.Actor{
+		Identity: o.nodeName,
+		Pod:      hostname,
+		Version:  version.Get().Version,
+	})
+	if err != nil {
+		klog.Fatal(err)
 	}
-	if err := mpodr.Run(reap, dryRun, namespace, hostIP); err != nil {
+	if err := mpodr.Run(o.role, reap, dryRun, o.namespace, o.reportNamespace, o.nodeName, o.hostIP, o.statusAddress, auditLog, policy, o.probePolicy); err != nil {
 		klog.Fatalf("Metal POD reaper failed:%s", err)
 	}
 }
+
+// discover fills in the namespace and node identity when not set
+func discover(o *options) error {
+	if o.namespace == "" {
+		namespace, err := kubeutils.GetNamespace()
+		if err != nil {
+			return fmt.Errorf("expecting NAMESPACE to be set: %s", err)
+		}
+		o.namespace = namespace
+		o.sources["namespace"] = sourceDiscovered
+	}
+	if o.reportNamespace == "" {
+		o.reportNamespace = o.namespace
+		o.sources["report-namespace"] = sourceDiscovered
+	}
+	if o.nodeName != "" && o.hostIP != "" {
+		return nil
+	}
+	cfg, err := kubeutils.BuildConfig()
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+	nodeName, hostIP, err := kubeutils.GetNodeIdentity(client, o.nodeName, o.hostIP)
+	if err != nil {
+		return fmt.Errorf("expecting NODE_NAME or HOST_IP to be set: %s", err)
+	}
+	if o.nodeName == "" {
+		o.nodeName = nodeName
+		o.sources["node-name"] = sourceDiscovered
+	}
+	if o.hostIP == "" {
+		o.hostIP = hostIP
+		o.sources["host-ip"] = sourceDiscovered
+	}
+	return nil
+}
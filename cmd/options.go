@@ -0,0 +1,336 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/detector"
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/monitor"
+	"github.com/appvia/metal-pod-reaper/pkg/mpodr"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	sourceDefault = "default"
+	sourceConfig  = "config"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+	// sourceDiscovered is set after parsing for options found from the cluster
+	sourceDiscovered = "discovered"
+)
+
+// Defaults shared with the simulate and explain subcommands so they behave as deployed
+const (
+	defaultEvictionTimeout  = time.Minute
+	defaultMinLeaseAge      = 40 * time.Second
+	defaultUnreachableAfter = 3
+	defaultReachableAfter   = 2
+)
+
+// envVars maps each option flag to the env var that can also set it
+var envVars = map[string]string{
+	"config":                      "CONFIG",
+	"mode":                        "MODE",
+	"role":                        "ROLE",
+	"namespace":                   "NAMESPACE",
+	"report-namespace":            "REPORT_NAMESPACE",
+	"host-ip":                     "HOST_IP",
+	"node-name":                   "NODE_NAME",
+	"delete-node-after":           "DELETE_NODE_AFTER",
+	"evict":                       "EVICT",
+	"eviction-timeout":            "EVICTION_TIMEOUT",
+	"report-retention":            "REPORT_RETENTION",
+	"unreachable-after":           "UNREACHABLE_AFTER",
+	"reachable-after":             "REACHABLE_AFTER",
+	"address-policy":              "ADDRESS_POLICY",
+	"icmp":                        "ICMP",
+	"probe-parallelism":           "PROBE_PARALLELISM",
+	"probe-timeout":               "PROBE_TIMEOUT",
+	"probe-interval":              "PROBE_INTERVAL",
+	"mesh-port":                   "MESH_PORT",
+	"min-lease-age":               "MIN_LEASE_AGE",
+	"require-storage-unreachable": "REQUIRE_STORAGE_UNREACHABLE",
+	"quorum":                      "QUORUM",
+	"topology-labels":             "TOPOLOGY_LABELS",
+	"status-address":              "STATUS_ADDRESS",
+	"audit-log":                   "AUDIT_LOG",
+	"audit-webhook":               "AUDIT_WEBHOOK",
+	"max-apiserver-latency":       "MAX_APISERVER_LATENCY",
+	"max-unreachable-nodes":       "MAX_UNREACHABLE_NODES",
+}
+
+// options are the settings for the long running reaper
+// - each can be set by flag, env var or config file (in that order of precedence)
+type options struct {
+	config          string
+	mode            string
+	role            string
+	namespace       string
+	reportNamespace string
+	hostIP          string
+	nodeName        string
+	deleteNodeAfter time.Duration
+	evict           bool
+	evictionTimeout time.Duration
+	requireStorage  bool
+	minLeaseAge     time.Duration
+	reportRetention time.Duration
+	maxLatency      time.Duration
+	maxUnreachable  int
+	quorum          string
+	topologyLabels  string
+	statusAddress   string
+	auditLog        string
+	auditWebhook    string
+	probePolicy     detector.ProbePolicy
+	version         bool
+
+	// sources records where each option was set from
+	sources map[string]string
+}
+
+// addFlags registers all the options on a flagset
+func (o *options) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.config, "config", "", "yaml file of options keyed by flag name (env - CONFIG)")
+	fs.StringVar(&o.mode, "mode", mpodr.ModeDryRun, "observe|dry-run|enforce (env - MODE)")
+	fs.StringVar(&o.role, "role", mpodr.RoleAll, "which components to run detector|monitor|all (env - ROLE)")
+	fs.StringVar(&o.namespace, "namespace", "", "namespace for the master leaselock object, discovered from the service account if not set (env - NAMESPACE)")
+	fs.StringVar(&o.reportNamespace, "report-namespace", "", "namespace the detectors write their reports to, the namespace if not set (env - REPORT_NAMESPACE)")
+	fs.StringVar(&o.hostIP, "host-ip", "", "specify the host ip, discovered from the node if not set (env - HOST_IP)")
+	fs.StringVar(&o.nodeName, "node-name", "", "specify the node name, discovered from the local addresses if not set (env - NODE_NAME)")
+	fs.DurationVar(&o.deleteNodeAfter, "delete-node-after", 0, "delete fenced nodes NotReady for longer than this, 0 to disable (env - DELETE_NODE_AFTER)")
+	fs.BoolVar(&o.evict, "evict", false, "use the eviction api before force deleting pods (env - EVICT)")
+	fs.DurationVar(&o.evictionTimeout, "eviction-timeout", defaultEvictionTimeout, "how long evicted pods are left terminating (or refused evictions retried) before they are force deleted (env - EVICTION_TIMEOUT)")
+	fs.StringVar(&o.probePolicy.ICMP, "icmp", detector.ICMPAuto, "ICMP sockets to probe with auto|privileged|unprivileged (env - ICMP)")
+	fs.IntVar(&o.probePolicy.Parallelism, "probe-parallelism", 16, "most probes to run at once (env - PROBE_PARALLELISM)")
+	fs.DurationVar(&o.probePolicy.Timeout, "probe-timeout", 5*time.Second, "time for each probe target to answer (env - PROBE_TIMEOUT)")
+	fs.DurationVar(&o.probePolicy.Interval, "probe-interval", 5*time.Second, "time between probe rounds, jittered by up to half (env - PROBE_INTERVAL)")
+	fs.IntVar(&o.probePolicy.MeshPort, "mesh-port", 0, "UDP port for a heartbeat mesh between detectors on the host network, 0 to disable (env - MESH_PORT)")
+	fs.DurationVar(&o.minLeaseAge, "min-lease-age", defaultMinLeaseAge, "node Lease must be older than this before a node is accused or reaped, 0 to disable (env - MIN_LEASE_AGE)")
+	fs.BoolVar(&o.requireStorage, "require-storage-unreachable", false, "only reap nodes with a storage-ip annotation once the storage network is also unreachable (env - REQUIRE_STORAGE_UNREACHABLE)")
+	fs.IntVar(&o.maxUnreachable, "max-unreachable-nodes", 0, "reap nothing while more nodes than this are agreed unreachable, 0 to disable (env - MAX_UNREACHABLE_NODES)")
+	fs.StringVar(&o.quorum, "quorum", kubeutils.QuorumAll, "reporters that must agree a node is unreachable all|cross-domain (env - QUORUM)")
+	fs.StringVar(&o.topologyLabels, "topology-labels", strings.Join(kubeutils.DefaultTopologyLabels, ","), "node labels that make up a failure domain (env - TOPOLOGY_LABELS)")
+	fs.DurationVar(&o.reportRetention, "report-retention", 10*time.Minute, "delete reports not updated for longer than this, 0 to keep (env - REPORT_RETENTION)")
+	fs.IntVar(&o.probePolicy.UnreachableAfter, "unreachable-after", defaultUnreachableAfter, "consecutive failed probe rounds before a node is reported unreachable (env - UNREACHABLE_AFTER)")
+	fs.IntVar(&o.probePolicy.ReachableAfter, "reachable-after", defaultReachableAfter, "consecutive successful probe rounds before a node is reported reachable again (env - REACHABLE_AFTER)")
+	fs.StringVar(&o.probePolicy.AddressPolicy, "address-policy", detector.AddressPolicyAllFail, "a node with several addresses is down when all-fail|any-fail (env - ADDRESS_POLICY)")
+	fs.DurationVar(&o.maxLatency, "max-apiserver-latency", monitor.DefaultMaxAPIServerLatency, "longest the monitor's apiserver heartbeat may take before it refuses to decide (env - MAX_APISERVER_LATENCY)")
+	fs.StringVar(&o.statusAddress, "status-address", "", "address to serve the monitor status and dry-run plans on e.g. :8080, empty to disable (env - STATUS_ADDRESS)")
+	fs.StringVar(&o.auditLog, "audit-log", "", "file to append an audit entry to for every consensus change and reap, - for stdout, empty to disable (env - AUDIT_LOG)")
+	fs.StringVar(&o.auditWebhook, "audit-webhook", "", "url to post every audit entry to, empty to disable (env - AUDIT_WEBHOOK)")
+	fs.BoolVar(&o.version, "version", false, "display the version")
+}
+
+// parse sets the options from the args, env and config file
+// - getenv is os.Getenv (other than when testing)
+func (o *options) parse(fs *flag.FlagSet, args []string, getenv func(string) string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	o.sources = make(map[string]string)
+	for name := range envVars {
+		o.sources[name] = sourceDefault
+	}
+	// Remember the flags given so they can be re-applied last
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := envVars[f.Name]; ok {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+
+	// The config file itself can only come from a flag or env
+	if _, ok := flags["config"]; !ok && getenv(envVars["config"]) != "" {
+		o.config = getenv(envVars["config"])
+	}
+	if o.config != "" {
+		data, err := ioutil.ReadFile(o.config)
+		if err != nil {
+			return fmt.Errorf("error reading config %s: %s", o.config, err)
+		}
+		config := make(map[string]interface{})
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("error decoding config %s: %s", o.config, err)
+		}
+		for name, value := range config {
+			if _, ok := envVars[name]; !ok || name == "config" {
+				return fmt.Errorf("unknown option %s in config %s", name, o.config)
+			}
+			if err := o.set(fs, name, fmt.Sprint(value), sourceConfig); err != nil {
+				return err
+			}
+		}
+	}
+	for name, env := range envVars {
+		if value := getenv(env); value != "" {
+			if err := o.set(fs, name, value, sourceEnv); err != nil {
+				return err
+			}
+		}
+	}
+	for name, value := range flags {
+		if err := o.set(fs, name, value, sourceFlag); err != nil {
+			return err
+		}
+	}
+	return o.validate()
+}
+
+// validate checks the options make sense together
+func (o *options) validate() error {
+	if _, _, err := mpodr.ParseMode(o.mode); err != nil {
+		return err
+	}
+	if !detector.IsValidAddressPolicy(o.probePolicy.AddressPolicy) {
+		return fmt.Errorf("expecting address-policy of %s or %s not %q", detector.AddressPolicyAllFail, detector.AddressPolicyAnyFail, o.probePolicy.AddressPolicy)
+	}
+	if !detector.IsValidICMPMode(o.probePolicy.ICMP) {
+		return fmt.Errorf("expecting icmp of %s, %s or %s not %q", detector.ICMPAuto, detector.ICMPPrivileged, detector.ICMPUnprivileged, o.probePolicy.ICMP)
+	}
+	if !kubeutils.IsValidQuorum(o.quorum) {
+		return fmt.Errorf("expecting quorum of %s or %s not %q", kubeutils.QuorumAll, kubeutils.QuorumCrossDomain, o.quorum)
+	}
+	if err := o.probePolicy.ValidRounds(); err != nil {
+		return err
+	}
+	if o.probePolicy.Parallelism < 1 {
+		return fmt.Errorf("expecting probe-parallelism of at least 1 not %d", o.probePolicy.Parallelism)
+	}
+	if !mpodr.IsValidRole(o.role) {
+		return fmt.Errorf("expecting role of %s, %s or %s not %q", mpodr.RoleDetector, mpodr.RoleMonitor, mpodr.RoleAll, o.role)
+	}
+	if o.maxLatency <= 0 {
+		return fmt.Errorf("expecting max-apiserver-latency of more than zero not %s", o.maxLatency)
+	}
+	if o.maxUnreachable < 0 {
+		return fmt.Errorf("expecting max-unreachable-nodes of at least 0 not %d", o.maxUnreachable)
+	}
+	if o.evictionTimeout <= 0 {
+		return fmt.Errorf("expecting eviction-timeout of more than zero not %s", o.evictionTimeout)
+	}
+	return nil
+}
+
+// consensusPolicy is the consensus policy for a quorum and comma separated topology labels
+func consensusPolicy(quorum, topologyLabels string) kubeutils.ConsensusPolicy {
+	policy := kubeutils.ConsensusPolicy{Quorum: quorum}
+	for _, label := range strings.Split(topologyLabels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			policy.TopologyLabels = append(policy.TopologyLabels, label)
+		}
+	}
+	return policy
+}
+
+// String describes the effective options and where they were set from
+func (o *options) String() string {
+	var names []string
+	for name := range o.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var settings []string
+	for _, name := range names {
+		settings = append(settings, fmt.Sprintf("%s=%s (%s)", name, o.value(name), o.sources[name]))
+	}
+	return strings.Join(settings, " ")
+}
+
+// redactURL hides the user info and query of a url as they commonly hold a token
+// - a url that can't be parsed is hidden completely
+func redactURL(s string) string {
+	if s == "" {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "redacted"
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.String()
+}
+
+func (o *options) set(fs *flag.FlagSet, name, value, source string) error {
+	if err := fs.Set(name, value); err != nil {
+		if source == sourceFlag {
+			return err
+		}
+		return fmt.Errorf("invalid %s from %s: %s", name, source, err)
+	}
+	o.sources[name] = source
+	return nil
+}
+
+func (o *options) value(name string) string {
+	switch name {
+	case "config":
+		return o.config
+	case "mode":
+		return o.mode
+	case "role":
+		return o.role
+	case "namespace":
+		return o.namespace
+	case "report-namespace":
+		return o.reportNamespace
+	case "host-ip":
+		return o.hostIP
+	case "node-name":
+		return o.nodeName
+	case "delete-node-after":
+		return o.deleteNodeAfter.String()
+	case "evict":
+		return fmt.Sprint(o.evict)
+	case "eviction-timeout":
+		return o.evictionTimeout.String()
+	case "min-lease-age":
+		return o.minLeaseAge.String()
+	case "require-storage-unreachable":
+		return fmt.Sprint(o.requireStorage)
+	case "report-retention":
+		return o.reportRetention.String()
+	case "max-apiserver-latency":
+		return o.maxLatency.String()
+	case "max-unreachable-nodes":
+		return fmt.Sprint(o.maxUnreachable)
+	case "quorum":
+		return o.quorum
+	case "topology-labels":
+		return o.topologyLabels
+	case "status-address":
+		return o.statusAddress
+	case "audit-log":
+		return o.auditLog
+	case "audit-webhook":
+		return redactURL(o.auditWebhook)
+	case "unreachable-after":
+		return fmt.Sprint(o.probePolicy.UnreachableAfter)
+	case "reachable-after":
+		return fmt.Sprint(o.probePolicy.ReachableAfter)
+	case "address-policy":
+		return o.probePolicy.AddressPolicy
+	case "icmp":
+		return o.probePolicy.ICMP
+	case "probe-parallelism":
+		return fmt.Sprint(o.probePolicy.Parallelism)
+	case "probe-timeout":
+		return o.probePolicy.Timeout.String()
+	case "probe-interval":
+		return o.probePolicy.Interval.String()
+	case "mesh-port":
+		return fmt.Sprint(o.probePolicy.MeshPort)
+	}
+	return ""
+}
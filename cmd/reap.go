@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"text/tabwriter"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/reaper"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	manualReapComponent = "metal-pod-reaper-cli"
+	manualReapPoll      = 5 * time.Second
+)
+
+// runReap reaps a single named node on request of an operator
+// - the node must be NotReady
+// - always shows the plan (a server side dry-run) and only acts with -confirm
+// - the operator recorded is the user the API server knows, -by is only a note
+func runReap(args []string) {
+	var nodeName string
+	var confirm bool
+	var evict bool
+	var evictionTimeout time.Duration
+	var by string
+
+	fs := flag.NewFlagSet("reap", flag.ExitOnError)
+	fs.StringVar(&nodeName, "node", "", "name of the NotReady node to reap")
+	fs.BoolVar(&confirm, "confirm", false, "actually reap the node (otherwise only the plan is shown)")
+	fs.BoolVar(&evict, "evict", false, "use the eviction api before force deleting pods")
+	fs.DurationVar(&evictionTimeout, "eviction-timeout", defaultEvictionTimeout, "how long evicted pods are left terminating (or refused evictions retried) before they are force deleted")
+	fs.StringVar(&by, "by", getOperator(), "a note recorded with the reap e.g. the person or ticket (the operator is the kubernetes user)")
+	fs.Parse(args)
+
+	if nodeName == "" {
+		klog.Fatal("Expecting -node to be set")
+	}
+	if evictionTimeout <= 0 {
+		klog.Fatal("Expecting -eviction-timeout to be more than zero")
+	}
+	cfg, err := kubeutils.BuildConfig()
+	if err != nil {
+		klog.Fatalf("error getting kubernetes config: %s", err)
+	}
+	operator, err := kubeutils.WhoAmI(cfg)
+	if err != nil {
+		klog.Fatalf("error identifying the operator: %s", err)
+	}
+	reapedBy := operator
+	if by != "" {
+		reapedBy = fmt.Sprintf("%s (note %q)", operator, by)
+	}
+	client := clientset.NewForConfigOrDie(cfg)
+	node, err := client.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.Fatalf("error getting node %s: %s", nodeName, err)
+	}
+	since, notReady := kubeutils.GetNodeNotReadySince(node)
+	if !notReady {
+		klog.Fatalf("refusing to reap node %s as it is Ready", nodeName)
+	}
+	policy := reaper.Policy{
+		Evict:           evict,
+		EvictionTimeout: evictionTimeout,
+	}
+
+	fmt.Printf("Node %s NotReady for %s\n\nPlan:\n", nodeName, time.Since(since).Round(time.Second))
+	plan, err := reaper.Reap(node, client, true, policy, time.Now())
+	if err != nil {
+		klog.Fatal(err)
+	}
+	printResult(plan)
+	if !confirm {
+		fmt.Println("\nDry-run only, re-run with -confirm to reap the node")
+		return
+	}
+
+	fmt.Printf("\nReaping node %s (by %s):\n", nodeName, reapedBy)
+	if err := kubeutils.AnnotateNode(client, nodeName, kubeutils.AnnotationManualReapBy, operator); err != nil {
+		klog.Fatal(err)
+	}
+	if err := kubeutils.AnnotateNode(client, nodeName, kubeutils.AnnotationManualReapNote, by); err != nil {
+		klog.Fatal(err)
+	}
+	result, err := reaper.Reap(node, client, false, policy, time.Now())
+	// Evicted pods are only force deleted once the eviction timeout has passed
+	for err == nil && result.Err() == nil && result.Pending() {
+		printResult(result)
+		fmt.Println("\nWaiting for evicted pods...")
+		time.Sleep(manualReapPoll)
+		result, err = reaper.Reap(node, client, false, policy, time.Now())
+	}
+	if err != nil {
+		recordManualReap(client, node, v1.EventTypeWarning, "ReapFailed", fmt.Sprintf("manual reap by %s failed: %s", reapedBy, err))
+		klog.Fatal(err)
+	}
+	printResult(result)
+	if err := result.Err(); err != nil {
+		recordManualReap(client, node, v1.EventTypeWarning, "ReapFailed", fmt.Sprintf("manual reap by %s %s: %s", reapedBy, result, err))
+		klog.Fatalf("error reaping pods from %s: %s", nodeName, err)
+	}
+	recordManualReap(client, node, v1.EventTypeNormal, "Reaped", fmt.Sprintf("manual reap by %s %s", reapedBy, result))
+	if err := kubeutils.AnnotateNode(client, nodeName, kubeutils.AnnotationReapedAt, time.Now().Format(time.RFC3339)); err != nil {
+		klog.Error(err)
+	}
+}
+
+func recordManualReap(client clientset.Interface, node *v1.Node, eventType, reason, message string) {
+	if err := kubeutils.CreateNodeEvent(client, node, manualReapComponent, eventType, reason, message); err != nil {
+		klog.Error(err)
+	}
+}
+
+func printResult(result *reaper.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tOUTCOME\tPATH\tDETAIL")
+	for _, p := range result.Pods {
+		detail := p.Reason
+		if p.Error != "" {
+			detail = p.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Namespace, p.Name, p.Outcome, p.Path, detail)
+	}
+	w.Flush()
+	fmt.Println(result)
+}
+
+// getOperator is the local user running a command as user@host
+func getOperator() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s", name, host)
+}
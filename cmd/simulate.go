@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/audit"
+	"github.com/appvia/metal-pod-reaper/pkg/detector"
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/reaper"
+	"github.com/appvia/metal-pod-reaper/pkg/simulator"
+	"github.com/appvia/metal-pod-reaper/pkg/snapshot"
+	"k8s.io/klog"
+)
+
+// runSimulate replays a snapshot and timeline offline and prints what would be reaped when
+func runSimulate(args []string) {
+	var snapshotPath string
+	var timelinePath string
+	var output string
+	var topologyLabels string
+	var auditLog string
+	var cfg simulator.Config
+
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	fs.StringVar(&snapshotPath, "snapshot", "", "snapshot of nodes, pods and reports (yaml, json or a snapshot archive)")
+	fs.StringVar(&timelinePath, "timeline", "", "timeline of node and probe changes (yaml or json)")
+	fs.StringVar(&output, "o", "table", "output format (table|json)")
+	fs.StringVar(&cfg.Namespace, "namespace", "kube-system", "namespace for the simulated reports")
+	fs.DurationVar(&cfg.Interval, "interval", 5*time.Second, "time between detector and monitor passes")
+	fs.DurationVar(&cfg.Duration, "duration", 0, "length of the simulation (default last step plus 5m)")
+	fs.DurationVar(&cfg.Policy.DeleteNodeAfter, "delete-node-after", 0, "delete fenced nodes NotReady for longer than this, 0 to disable")
+	fs.BoolVar(&cfg.Policy.Pods.Evict, "evict", false, "use the eviction api before force deleting pods")
+	fs.DurationVar(&cfg.Policy.Pods.EvictionTimeout, "eviction-timeout", defaultEvictionTimeout, "how long evicted pods are left terminating (or refused evictions retried) before they are force deleted")
+	fs.IntVar(&cfg.Probe.UnreachableAfter, "unreachable-after", defaultUnreachableAfter, "consecutive failed probe rounds before a node is reported unreachable")
+	fs.IntVar(&cfg.Probe.ReachableAfter, "reachable-after", defaultReachableAfter, "consecutive successful probe rounds before a node is reported reachable again")
+	fs.DurationVar(&cfg.Policy.MinLeaseAge, "min-lease-age", defaultMinLeaseAge, "node Lease must be older than this before a node is accused or reaped, 0 to disable")
+	fs.BoolVar(&cfg.Policy.RequireStorageUnreachable, "require-storage-unreachable", false, "only reap nodes with a storage-ip annotation once the storage network is also unreachable")
+	fs.IntVar(&cfg.Policy.MaxUnreachableNodes, "max-unreachable-nodes", 0, "reap nothing while more nodes than this are agreed unreachable, 0 to disable")
+	fs.StringVar(&cfg.Policy.Consensus.Quorum, "quorum", kubeutils.QuorumAll, "reporters that must agree a node is unreachable all|cross-domain")
+	fs.StringVar(&topologyLabels, "topology-labels", strings.Join(kubeutils.DefaultTopologyLabels, ","), "node labels that make up a failure domain")
+	fs.StringVar(&cfg.Probe.AddressPolicy, "address-policy", detector.AddressPolicyAllFail, "a node with several addresses is down when all-fail|any-fail")
+	fs.StringVar(&auditLog, "audit-log", "", "file to append the monitor audit entries to, - for stdout")
+	fs.Parse(args)
+	cfg.Policy.Consensus = consensusPolicy(cfg.Policy.Consensus.Quorum, topologyLabels)
+
+	if snapshotPath == "" || timelinePath == "" {
+		klog.Fatal("Expecting -snapshot and -timeline to be set")
+	}
+	if cfg.Interval <= 0 {
+		klog.Fatal("Expecting -interval to be more than zero")
+	}
+	if err := cfg.Probe.ValidRounds(); err != nil {
+		klog.Fatal(err)
+	}
+	if cfg.Policy.Pods.Evict && cfg.Policy.Pods.EvictionTimeout <= 0 {
+		klog.Fatal("Expecting -eviction-timeout to be more than zero")
+	}
+	snap, err := snapshot.Load(snapshotPath)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	timeline, err := simulator.LoadTimeline(timelinePath)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	if cfg.Duration == 0 {
+		if len(timeline.Steps) > 0 {
+			cfg.Duration = timeline.Steps[len(timeline.Steps)-1].At.Duration
+		}
+		cfg.Duration += 5 * time.Minute
+	}
+	if auditLog != "" {
+		cfg.Audit, err = audit.New(auditLog, "", audit.Actor{Identity: "simulator"})
+		if err != nil {
+			klog.Fatal(err)
+		}
+	}
+	events, err := simulator.Run(snap, timeline, cfg)
+	if err != nil {
+		klog.Fatalf("simulation failed: %s", err)
+	}
+
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(events); err != nil {
+			klog.Fatalf("error encoding events: %s", err)
+		}
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "AT\tNODE\tEVENT")
+		for _, e := range events {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", e.At.Duration, e.Node, e.Message)
+			for _, p := range e.Pods {
+				switch p.Outcome {
+				case reaper.OutcomeDeleted:
+					fmt.Fprintf(w, "\t\t  pod %s/%s deleted via %s\n", p.Namespace, p.Name, p.Path)
+				case reaper.OutcomeEvicted:
+					fmt.Fprintf(w, "\t\t  pod %s/%s evicted\n", p.Namespace, p.Name)
+				}
+			}
+		}
+		w.Flush()
+	default:
+		klog.Fatalf("unknown output format %s", output)
+	}
+}
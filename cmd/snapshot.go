@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/snapshot"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// runSnapshot captures the cluster state into an archive for replay with simulate
+func runSnapshot(args []string) {
+	var namespace string
+	var reportNamespace string
+	var file string
+	var allPods bool
+
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	fs.StringVar(&namespace, "namespace", os.Getenv("NAMESPACE"), "namespace of the monitor holding the node snapshots (env - NAMESPACE)")
+	fs.StringVar(&reportNamespace, "report-namespace", os.Getenv("REPORT_NAMESPACE"), "namespace holding the reports, the namespace if not set (env - REPORT_NAMESPACE)")
+	fs.StringVar(&file, "f", "", "archive to write (default mpodr-snapshot-<time>.tar.gz)")
+	fs.BoolVar(&allPods, "all-pods", false, "capture all pods, not only those on NotReady nodes")
+	fs.Parse(args)
+
+	if namespace == "" {
+		klog.Fatal("Expecting -namespace or NAMESPACE to be set")
+	}
+	if reportNamespace == "" {
+		reportNamespace = namespace
+	}
+	cfg, err := kubeutils.BuildConfig()
+	if err != nil {
+		klog.Fatalf("error getting kubernetes config: %s", err)
+	}
+	client := clientset.NewForConfigOrDie(cfg)
+	snap, err := snapshot.Capture(client, namespace, reportNamespace, allPods)
+	if err != nil {
+		klog.Fatalf("error capturing snapshot: %s", err)
+	}
+	if file == "" {
+		file = fmt.Sprintf("mpodr-snapshot-%s.tar.gz", snap.CapturedAt.UTC().Format("20060102T150405Z"))
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		klog.Fatalf("error creating %s: %s", file, err)
+	}
+	if err := snap.WriteArchive(f); err != nil {
+		f.Close()
+		klog.Fatalf("error writing %s: %s", file, err)
+	}
+	if err := f.Close(); err != nil {
+		klog.Fatalf("error writing %s: %s", file, err)
+	}
+	fmt.Printf("captured %d nodes, %d pods, %d reports, %d volume attachments and %d leases to %s\n",
+		len(snap.Nodes), len(snap.Pods), len(snap.Reports), len(snap.VolumeAttachments), len(snap.Leases), file)
+}
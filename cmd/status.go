@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// nodeStatus is the consensus for a NotReady node along with what has been done about it
+type nodeStatus struct {
+	kubeutils.NodeConsensus
+	NotReadySince time.Time `json:"notReadySince"`
+	ReapState     string    `json:"reapState"`
+}
+
+// runStatus prints the cluster wide consensus for every NotReady node
+func runStatus(args []string) {
+	var namespace string
+	var output string
+	var quorum string
+	var topologyLabels string
+
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.StringVar(&namespace, "namespace", getReportNamespace(), "namespace holding the reports (env - REPORT_NAMESPACE or NAMESPACE)")
+	fs.StringVar(&output, "o", "table", "output format (table|json)")
+	fs.StringVar(&quorum, "quorum", kubeutils.QuorumAll, "quorum as configured for the monitor all|cross-domain")
+	fs.StringVar(&topologyLabels, "topology-labels", strings.Join(kubeutils.DefaultTopologyLabels, ","), "failure domain labels as configured for the monitor")
+	fs.Parse(args)
+
+	if namespace == "" {
+		klog.Fatal("Expecting -namespace, REPORT_NAMESPACE or NAMESPACE to be set")
+	}
+	cfg, err := kubeutils.BuildConfig()
+	if err != nil {
+		klog.Fatalf("error getting kubernetes config: %s", err)
+	}
+	client := clientset.NewForConfigOrDie(cfg)
+	consensus, err := kubeutils.GetConsensus(client, namespace, consensusPolicy(quorum, topologyLabels))
+	if err != nil {
+		klog.Fatalf("error getting consensus: %s", err)
+	}
+	statuses := make([]nodeStatus, 0, len(consensus))
+	for _, nc := range consensus {
+		since, _ := kubeutils.GetNodeNotReadySince(nc.Node)
+		statuses = append(statuses, nodeStatus{
+			NodeConsensus: nc,
+			NotReadySince: since,
+			ReapState:     getReapState(nc),
+		})
+	}
+
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(statuses); err != nil {
+			klog.Fatalf("error encoding status: %s", err)
+		}
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NODE\tNOT-READY\tAGREEING\tDISAGREEING\tUNCHECKED\tSTALE\tQUORUM\tVERDICT\tREAP-STATE")
+		for _, s := range statuses {
+			verdict := "reachable"
+			if s.Unreachable {
+				verdict = "unreachable"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+				s.NodeName,
+				time.Since(s.NotReadySince).Round(time.Second),
+				formatReporters(s.Agreeing),
+				formatReporters(s.Disagreeing),
+				formatReporters(s.Unchecked),
+				formatReporters(s.Stale),
+				s.Quorum,
+				verdict,
+				s.ReapState)
+		}
+		w.Flush()
+	default:
+		klog.Fatalf("unknown output format %s", output)
+	}
+}
+
+// getReportNamespace is the namespace holding the reports from the environment
+func getReportNamespace() string {
+	if namespace := os.Getenv("REPORT_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	return os.Getenv("NAMESPACE")
+}
+
+func getReapState(nc kubeutils.NodeConsensus) string {
+	if reapedAt, ok := kubeutils.GetNodeReapedAt(nc.Node); ok {
+		return "reaped " + reapedAt.Format(time.RFC3339)
+	}
+	if nc.Unreachable {
+		return "pending"
+	}
+	return "-"
+}
+
+func formatReporters(reporters []string) string {
+	if len(reporters) == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d (%s)", len(reporters), strings.Join(reporters, ","))
+}
@@ -0,0 +1,211 @@
+// Package audit keeps a durable record of every decision and action taken by the monitor
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// EventConsensus the consensus for a node changed
+	EventConsensus = "consensus"
+	// EventReap pods were reaped from a node (or would have been in dry-run)
+	EventReap = "reap"
+	// EventDeleteNode a Node object was deleted (or would have been in dry-run)
+	EventDeleteNode = "delete-node"
+
+	// Stdout is the path used to write entries to stdout
+	Stdout = "-"
+
+	webhookTimeout = 5 * time.Second
+	// webhookQueueSize is the most entries waiting to be posted, more are dropped
+	webhookQueueSize = 1000
+	// webhookAttempts is how many times an entry is posted before it is dropped
+	webhookAttempts = 5
+	// webhookBackoff is the wait before the first retry (doubled each retry)
+	webhookBackoff = time.Second
+)
+
+// Actor identifies who made a decision
+type Actor struct {
+	// Identity is the leader election identity of the monitor
+	Identity string `json:"identity"`
+	// Pod is the hostname of the monitor (the pod name)
+	Pod     string `json:"pod,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// Entry is a single audit record
+type Entry struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Node  string    `json:"node"`
+	Actor Actor     `json:"actor"`
+	// PolicyVersion identifies the mode and policy the decision was made with
+	PolicyVersion string `json:"policyVersion"`
+	DryRun        bool   `json:"dryRun"`
+	// Evidence is what the decision was based on (encoded as json)
+	Evidence interface{} `json:"evidence,omitempty"`
+	Outcome  string      `json:"outcome"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// Log writes audit entries as json lines and posts them to a webhook
+// - a nil Log discards entries
+// - entries are posted in the background so a slow webhook never blocks the caller
+type Log struct {
+	// dropped counts entries that could not be posted to the webhook (first
+	// for 64 bit alignment on 32 bit platforms)
+	dropped int64
+
+	actor   Actor
+	webhook string
+	client  *http.Client
+	queue   chan []byte
+	backoff time.Duration
+
+	mu sync.Mutex
+	w  io.Writer
+	f  *os.File
+}
+
+// New opens an audit log
+// - path is appended to (Stdout for stdout), empty to only use the webhook
+// - webhook is a url each entry is posted to, empty to disable
+func New(path, webhook string, actor Actor) (*Log, error) {
+	l := &Log{
+		actor:   actor,
+		webhook: webhook,
+		client:  &http.Client{Timeout: webhookTimeout},
+		backoff: webhookBackoff,
+	}
+	switch path {
+	case "":
+	case Stdout:
+		l.w = os.Stdout
+	default:
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("error opening audit log %s: %s", path, err)
+		}
+		l.w = f
+		l.f = f
+	}
+	if webhook != "" {
+		l.queue = make(chan []byte, webhookQueueSize)
+		go l.deliver()
+	}
+	return l, nil
+}
+
+// Record writes an entry to the log and queues it for the webhook
+// - the time and actor are filled in when not set
+// - an error writing the log is logged and returned
+// - an entry that can't be queued (or posted) is logged and counted as dropped
+func (l *Log) Record(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Actor == (Actor{}) {
+		e.Actor = l.actor
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding audit entry for %s: %s", e.Node, err)
+	}
+	l.enqueue(b, e)
+	if err := l.write(b); err != nil {
+		err := fmt.Errorf("error recording audit entry %s for %s: %s", e.Event, e.Node, err)
+		klog.Error(err)
+		return err
+	}
+	return nil
+}
+
+// Dropped is the number of entries that could not be posted to the webhook
+func (l *Log) Dropped() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.dropped)
+}
+
+func (l *Log) enqueue(b []byte, e Entry) {
+	if l.queue == nil {
+		return
+	}
+	select {
+	case l.queue <- b:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+		klog.Errorf("audit webhook queue full, dropped entry %s for %s", e.Event, e.Node)
+	}
+}
+
+// deliver posts queued entries in order, retrying with a backoff
+func (l *Log) deliver() {
+	for b := range l.queue {
+		backoff := l.backoff
+		var err error
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			if err = l.post(b); err == nil {
+				break
+			}
+			klog.V(2).Infof("audit webhook attempt %d of %d failed: %s", attempt, webhookAttempts, err)
+			if attempt < webhookAttempts {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		}
+		if err != nil {
+			atomic.AddInt64(&l.dropped, 1)
+			klog.Errorf("error posting audit entry, dropped after %d attempts: %s", webhookAttempts, err)
+		}
+	}
+}
+
+// write appends a line and syncs it to disk
+func (l *Log) write(b []byte) error {
+	if l.w == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if l.f != nil {
+		return l.f.Sync()
+	}
+	return nil
+}
+
+// post sends an entry to the webhook
+// - errors never include the url as it commonly holds a token
+func (l *Log) post(b []byte) error {
+	resp, err := l.client.Post(l.webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
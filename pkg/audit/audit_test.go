@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordPostsInTheBackground(t *testing.T) {
+	received := make(chan Entry, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var e Entry
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	}))
+	defer server.Close()
+	defer close(release)
+
+	l, err := New("", server.URL, Actor{Identity: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := l.Record(Entry{Event: EventReap, Node: "node3"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected record not to wait for the webhook, took %s", elapsed)
+	}
+	release <- struct{}{}
+	select {
+	case e := <-received:
+		if e.Node != "node3" || e.Actor.Identity != "master1" {
+			t.Errorf("unexpected entry %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the entry to be posted")
+	}
+}
+
+func TestRecordDropsAfterRetries(t *testing.T) {
+	attempts := make(chan struct{}, webhookAttempts)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	l, err := New("", server.URL, Actor{Identity: "master1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.backoff = time.Millisecond
+	if err := l.Record(Entry{Event: EventReap, Node: "node3"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Dropped() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped entry, got %d", l.Dropped())
+	}
+	if len(attempts) != webhookAttempts {
+		t.Errorf("expected %d attempts, got %d", webhookAttempts, len(attempts))
+	}
+}
+
+func TestPostErrorsHideTheWebhook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	defer server.Close()
+
+	for _, webhook := range []string{server.URL + "/entries?token=s3cret", closed.URL + "/entries?token=s3cret"} {
+		l, err := New("", webhook, Actor{Identity: "master1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = l.post([]byte("{}"))
+		if err == nil {
+			t.Fatalf("expected posting to %s to fail", webhook)
+		}
+		if strings.Contains(err.Error(), "s3cret") {
+			t.Errorf("expected the webhook url not to be in the error, got %s", err)
+		}
+	}
+}
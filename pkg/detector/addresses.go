@@ -0,0 +1,82 @@
+package detector
+
+import (
+	"fmt"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+)
+
+// IsValidAddressPolicy is true for a known address policy
+func IsValidAddressPolicy(policy string) bool {
+	return policy == "" || policy == AddressPolicyAllFail || policy == AddressPolicyAnyFail
+}
+
+// probeNode probes every address of a node concurrently and combines the results
+// - addresses that can't be probed are not evidence either way
+// - it is only an error when no cluster address could be probed
+// - addresses on other networks are recorded but don't change if the node is down
+func (d *Detector) probeNode(result nodeDown) nodeDown {
+	targets := make([]kubeutils.AddressResult, 0, len(result.NetNode.IPs)+len(result.NetNode.Extra))
+	for _, ip := range result.NetNode.IPs {
+		targets = append(targets, kubeutils.AddressResult{IP: ip})
+	}
+	for _, extra := range result.NetNode.Extra {
+		targets = append(targets, kubeutils.AddressResult{Network: extra.Network, IP: extra.IP})
+	}
+	d.probeAll(targets)
+	result.Addresses = targets[:len(result.NetNode.IPs)]
+	if len(result.NetNode.Extra) > 0 {
+		result.Networks = targets[len(result.NetNode.IPs):]
+	}
+
+	var probed, down int
+	var lastErr string
+	for _, address := range result.Addresses {
+		switch {
+		case address.Error != "":
+			lastErr = address.Error
+		case address.Reachable:
+			probed++
+		default:
+			probed++
+			down++
+		}
+	}
+	if probed == 0 {
+		result.Err = fmt.Errorf("no address of node %s could be probed: %s", result.NetNode.Node.Name, lastErr)
+		return result
+	}
+	if d.policy.AddressPolicy == AddressPolicyAnyFail {
+		result.IsNodeDown = down > 0
+	} else {
+		result.IsNodeDown = down == probed
+	}
+	return result
+}
+
+// probeAll probes all the targets concurrently and fills in the results
+// - no more than the policy parallelism run at once across all nodes
+func (d *Detector) probeAll(targets []kubeutils.AddressResult) {
+	type addressDown struct {
+		index int
+		down  bool
+		err   error
+	}
+	results := make(chan addressDown, len(targets))
+	for i := range targets {
+		go func(index int, ip string) {
+			// wait for a free worker
+			d.workers <- struct{}{}
+			defer func() { <-d.workers }()
+			down, err := d.probe(ip)
+			results <- addressDown{index: index, down: down, err: err}
+		}(i, targets[i].IP)
+	}
+	for range targets {
+		r := <-results
+		targets[r.index].Reachable = !r.down && r.err == nil
+		if r.err != nil {
+			targets[r.index].Error = r.err.Error()
+		}
+	}
+}
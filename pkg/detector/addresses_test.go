@@ -0,0 +1,99 @@
+package detector
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// probeOutcomes is a probe answering each address with an outcome (up, down or error)
+func probeOutcomes(outcomes map[string]string) ProbeFunc {
+	return func(ip string) (bool, error) {
+		switch outcomes[ip] {
+		case "up":
+			return false, nil
+		case "down":
+			return true, nil
+		default:
+			return false, fmt.Errorf("can't probe %s", ip)
+		}
+	}
+}
+
+func TestProbeNodeAddressPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcomes map[string]string
+		allFail  bool
+		anyFail  bool
+		err      bool
+	}{
+		{name: "all up", outcomes: map[string]string{"10.0.0.3": "up", "fd00::3": "up"}},
+		{name: "one down", outcomes: map[string]string{"10.0.0.3": "down", "fd00::3": "up"}, anyFail: true},
+		{name: "all down", outcomes: map[string]string{"10.0.0.3": "down", "fd00::3": "down"}, allFail: true, anyFail: true},
+		{name: "one down one error", outcomes: map[string]string{"10.0.0.3": "down", "fd00::3": "error"}, allFail: true, anyFail: true},
+		{name: "one up one error", outcomes: map[string]string{"10.0.0.3": "up", "fd00::3": "error"}},
+		{name: "all error", outcomes: map[string]string{"10.0.0.3": "error", "fd00::3": "error"}, err: true},
+	}
+	for _, test := range tests {
+		for _, policy := range []string{AddressPolicyAllFail, AddressPolicyAnyFail} {
+			t.Run(test.name+" "+policy, func(t *testing.T) {
+				d, _, _ := newTestDetector(probeOutcomes(test.outcomes), ProbePolicy{AddressPolicy: policy})
+				node := testNode("node3", v1.ConditionUnknown, "10.0.0.3", "fd00::3")
+				result := d.probeNode(nodeDown{NetNode: kubeutils.NetNode{Node: node, IP: "10.0.0.3", IPs: []string{"10.0.0.3", "fd00::3"}}})
+				if (result.Err != nil) != test.err {
+					t.Fatalf("expected error=%t, got %v", test.err, result.Err)
+				}
+				down := test.allFail
+				if policy == AddressPolicyAnyFail {
+					down = test.anyFail
+				}
+				if result.IsNodeDown != down {
+					t.Errorf("expected down=%t, got %t", down, result.IsNodeDown)
+				}
+				if len(result.Addresses) != 2 {
+					t.Errorf("expected a result for each address, got %v", result.Addresses)
+				}
+			})
+		}
+	}
+}
+
+func TestCheckProbeParallelism(t *testing.T) {
+	const parallelism = 3
+	var mu sync.Mutex
+	var running, most, probes int
+	probe := func(ip string) (bool, error) {
+		mu.Lock()
+		running++
+		probes++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return true, nil
+	}
+	var nodes []runtime.Object
+	for i := 2; i < 12; i++ {
+		nodes = append(nodes, testNode(fmt.Sprintf("node%d", i), v1.ConditionUnknown, fmt.Sprintf("10.0.0.%d", i), fmt.Sprintf("fd00::%d", i)))
+	}
+	d, _, _ := newTestDetector(probe, ProbePolicy{Parallelism: parallelism}, nodes...)
+	if _, err := d.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if probes != 20 {
+		t.Errorf("expected every address to be probed, got %d probes", probes)
+	}
+	if most != parallelism {
+		t.Errorf("expected at most %d probes at once, got %d", parallelism, most)
+	}
+}
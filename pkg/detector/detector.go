@@ -3,30 +3,52 @@
 package detector
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
-	pinger "github.com/sparrc/go-ping"
+	"github.com/appvia/metal-pod-reaper/pkg/mesh"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 )
 
 const (
 	pingCount            = 5
-	pingTimeout          = time.Second * pingCount
+	defaultPingTimeout   = time.Second * pingCount
+	defaultInterval      = 5 * time.Second
+	defaultParallelism   = 16
+	meshInterval         = time.Second
+	meshSuspicionTimeout = 5 * time.Second
+	// loopJitter spreads the loops of all the detectors by up to half an interval
+	loopJitter           = 0.5
 	detectorCMNamePrefix = "metal-pod-reaper"
 	detectorCMPrefix     = "UnReachableIp"
 	detectorCMSuffix     = "NodeName"
 	detectorCMLabelName  = "creator"
 )
 
+// ProbeFunc reports if the node with the given ip is down
+type ProbeFunc func(ip string) (bool, error)
+
 // Detector provides data for detector methods
 type Detector struct {
 	c         chan error
 	client    clientset.Interface
+	clock     clock.Clock
 	dryRun    bool
 	hostIP    string
 	namespace string
+	nodeName  string
+	probe     ProbeFunc
+	policy    ProbePolicy
+	history   map[string]*history
+	// workers limits the number of probes running at once
+	workers chan struct{}
+	// mesh is the heartbeat mesh between detectors (when enabled)
+	mesh *mesh.Mesh
 }
 
 // Create a struct for reporting on async Pinging...
@@ -34,19 +56,36 @@ type nodeDown struct {
 	Err        error
 	NetNode    kubeutils.NetNode
 	IsNodeDown bool
+	Addresses  []kubeutils.AddressResult
+	Networks   []kubeutils.AddressResult
 }
 
 // New creates a default detector
-func New(dryRun bool, namespace, hostIP string) *Detector {
+// - reports are written to namespace
+func New(dryRun bool, namespace, nodeName, hostIP string, policy ProbePolicy) *Detector {
 	d := &Detector{
 		c:         make(chan error),
+		clock:     clock.RealClock{},
 		dryRun:    dryRun,
 		hostIP:    hostIP,
 		namespace: namespace,
+		nodeName:  nodeName,
+		policy:    policy,
+		history:   make(map[string]*history),
+		workers:   make(chan struct{}, policy.parallelism()),
 	}
 	return d
 }
 
+// NewForClient creates a detector with a given client, probe and clock (e.g. for simulation)
+func NewForClient(client clientset.Interface, probe ProbeFunc, clk clock.Clock, namespace, nodeName, hostIP string, policy ProbePolicy) *Detector {
+	d := New(false, namespace, nodeName, hostIP, policy)
+	d.client = client
+	d.probe = probe
+	d.clock = clk
+	return d
+}
+
 // RunAsync will start the detector and return a channel for errors
 func (d *Detector) RunAsync() chan (error) {
 	go func() {
@@ -66,108 +105,247 @@ func (d *Detector) Run() error {
 		return err
 	}
 	d.client = clientset.NewForConfigOrDie(cfg)
+	probe, err := newPingProbe(d.policy.ICMP, d.policy.timeout())
+	if err != nil {
+		return err
+	}
+	d.probe = probe
+	// Never publish reports while probing itself is broken
+	for {
+		err := d.SelfTest()
+		if err == nil {
+			break
+		}
+		klog.Errorf("self test failed, not publishing reports: %s", err)
+		time.Sleep(wait.Jitter(selfTestRetry, loopJitter))
+	}
+	if d.policy.MeshPort > 0 {
+		d.mesh = mesh.New(d.nodeName, mesh.Config{
+			Port:             d.policy.MeshPort,
+			Interval:         meshInterval,
+			SuspicionTimeout: meshSuspicionTimeout,
+		})
+		if err := d.mesh.Start(d.meshIP()); err != nil {
+			return err
+		}
+	}
 	klog.Info("node down detector started")
 	for {
 		// Don't thrash here..
-		time.Sleep(5 * time.Second)
+		time.Sleep(wait.Jitter(d.policy.interval(), loopJitter))
 
-		klog.V(5).Info("getting unready nodes")
-		unreadyNodes, err := kubeutils.GetUnreadyNodes(d.client)
+		checked, err := d.Check()
 		if err != nil {
-			klog.Errorf("error getting unschedulable nodes: %s", err)
+			klog.Error(err)
 			// No point digging, lets backoff
-			time.Sleep(10 * time.Second)
+			time.Sleep(wait.Jitter(2*d.policy.interval(), loopJitter))
 			continue
 		}
-		if len(unreadyNodes.Items) < 1 {
-			klog.V(3).Info("node down detector - all nodes ready")
-			time.Sleep(10 * time.Second)
-			continue
+		if checked == 0 {
+			time.Sleep(wait.Jitter(2*d.policy.interval(), loopJitter))
 		}
-		klog.Info("unready nodes detected")
-		// For all the unready check which ones are checkable (have pingable address...)
-		checkableNodes := make(map[string]nodeDown)
-		for _, node := range unreadyNodes.Items {
-			// Only check thos nodes with ip's
-			ip, err := kubeutils.GetNodeInternalIP(&node)
-			if err != nil {
-				klog.Errorf("will not check node %s as problem getting internal ip: %s", node.Name, err)
-			} else {
-				checkableNodes[node.Name] = nodeDown{
-					NetNode: kubeutils.NetNode{
-						Node: &node,
-						IP:   ip,
-					},
-				}
-			}
+	}
+}
+
+// Check probes all the unready nodes once and reports any that are unreachable
+// - a report is always published, even when nothing is unreachable, so recovered
+// nodes are no longer accused and it is clear this node is still reporting
+// - returns the number of unready nodes found
+func (d *Detector) Check() (int, error) {
+	klog.V(5).Info("getting unready nodes")
+	unreadyNodes, err := kubeutils.GetUnreadyNodes(d.client)
+	if err != nil {
+		return 0, fmt.Errorf("error getting unschedulable nodes: %s", err)
+	}
+	if len(unreadyNodes.Items) < 1 {
+		klog.V(3).Info("node down detector - all nodes ready")
+		d.history = make(map[string]*history)
+		if err := d.report(nil); err != nil {
+			return 0, fmt.Errorf("problem reporting no unreachable nodes: %s", err)
 		}
-		// Create a buffered channel for all the checks
-		results := make(chan nodeDown, len(checkableNodes))
-		for _, node := range checkableNodes {
-			// Do the checks concurrently:
-			go func(nodeName string) {
-				// Get the node details
-				result := checkableNodes[nodeName]
-				// do the check for this node
-				klog.V(4).Infof("about to check node %s with ip %s", nodeName, result.NetNode.IP)
-				nodeDown, err := isNodeDown(result.NetNode.IP)
-				// record the results
-				result.Err = err
-				result.IsNodeDown = nodeDown
-				if result.Err != nil {
-					klog.Errorf("error checking node %s, %s", result.NetNode.IP, result.Err)
-				} else {
-					if nodeDown {
-						klog.V(4).Infof("node %s is unreachable, repeat NOT reachable", result.NetNode.IP)
-					} else {
-						klog.V(4).Infof("node %s is reachable", result.NetNode.IP)
-					}
-				}
-				// Put the result on the channel (signal that the result is in)...
-				results <- result
-			}(node.NetNode.Node.Name)
+		return 0, nil
+	}
+	klog.Info("unready nodes detected")
+	// For all the unready check which ones are checkable (have pingable address...)
+	checkableNodes := make(map[string]nodeDown)
+	for i := range unreadyNodes.Items {
+		node := &unreadyNodes.Items[i]
+		// Only check thos nodes with ip's
+		ips, err := kubeutils.GetNodeInternalIPs(node)
+		if err != nil {
+			klog.Errorf("will not check node %s as problem getting internal ip: %s", node.Name, err)
+		} else {
+			checkableNodes[node.Name] = nodeDown{
+				NetNode: kubeutils.NetNode{
+					Node:  node,
+					IP:    ips[0],
+					IPs:   ips,
+					Extra: kubeutils.GetNodeExtraTargets(node),
+				},
+			}
 		}
-		var unReachableNodes []kubeutils.NetNode
-		// Now wait till the results are in for all nodes:
-		for nodeIndex := 1; nodeIndex <= len(checkableNodes); nodeIndex++ {
-			klog.V(4).Infof("waiting for node result %d of %d", nodeIndex, len(checkableNodes))
-			nodeResult := <-results
-			klog.V(4).Infof("got node result %d of %d", nodeIndex, len(checkableNodes))
-			if nodeResult.Err != nil {
-				klog.Errorf("problem reporting on node ip %s: %s", nodeResult.NetNode.IP, nodeResult.Err)
+	}
+	// Create a buffered channel for all the checks
+	results := make(chan nodeDown, len(checkableNodes))
+	for _, node := range checkableNodes {
+		// Do the checks concurrently:
+		go func(result nodeDown) {
+			// do the check for this node
+			klog.V(4).Infof("about to check node %s with ips %v", result.NetNode.Node.Name, result.NetNode.IPs)
+			result = d.probeNode(result)
+			if result.Err != nil {
+				klog.Errorf("error checking node %s, %s", result.NetNode.Node.Name, result.Err)
 			} else {
-				if nodeResult.IsNodeDown {
-					klog.Warningf("unreachable node detected %s", nodeResult.NetNode.IP)
-					unReachableNodes = append(unReachableNodes, nodeResult.NetNode)
+				if result.IsNodeDown {
+					klog.V(4).Infof("node %s is unreachable, repeat NOT reachable", result.NetNode.Node.Name)
 				} else {
-					klog.V(2).Infof("unready node still reachable %s", nodeResult.NetNode.IP)
+					klog.V(4).Infof("node %s is reachable", result.NetNode.Node.Name)
 				}
 			}
-			klog.V(4).Infof("completed processing node result %d of %d", nodeIndex, len(checkableNodes))
+			// Put the result on the channel (signal that the result is in)...
+			results <- result
+		}(node)
+	}
+	leases, err := kubeutils.GetNodeLeases(d.client)
+	if err != nil {
+		klog.Errorf("not using node leases: %s", err)
+	}
+	var probeResults []kubeutils.ProbeResult
+	// Forget the history of nodes that are no longer checked (e.g. Ready again)
+	for name := range d.history {
+		if _, ok := checkableNodes[name]; !ok {
+			delete(d.history, name)
+		}
+	}
+	// Now wait till the results are in for all nodes:
+	for nodeIndex := 1; nodeIndex <= len(checkableNodes); nodeIndex++ {
+		klog.V(4).Infof("waiting for node result %d of %d", nodeIndex, len(checkableNodes))
+		nodeResult := <-results
+		klog.V(4).Infof("got node result %d of %d", nodeIndex, len(checkableNodes))
+		name := nodeResult.NetNode.Node.Name
+		h, ok := d.history[name]
+		if !ok {
+			h = &history{}
+			d.history[name] = h
+		}
+		probeResult := kubeutils.ProbeResult{
+			Node:      name,
+			IP:        nodeResult.NetNode.IP,
+			Time:      d.clock.Now(),
+			Addresses: nodeResult.Addresses,
+			Networks:  nodeResult.Networks,
+		}
+		renewed, hasLease := leases[name]
+		if hasLease {
+			probeResult.LeaseAge = &metav1.Duration{Duration: d.clock.Since(renewed)}
 		}
-		klog.V(4).Infof("we have reported on %d unreachable nodes", len(unReachableNodes))
-		if len(unReachableNodes) > 0 {
-			// Report on all failed nodes together:
-			if err := kubeutils.ReportUnreachableIPs(d.client, unReachableNodes, d.hostIP, d.namespace); err != nil {
-				klog.Errorf("problem reporting unreachable nodes: %s", err)
+		if nodeResult.Err != nil {
+			klog.Errorf("problem reporting on node ip %s: %s", nodeResult.NetNode.IP, nodeResult.Err)
+			// Not evidence either way (and not added to the history)
+			probeResult.Error = nodeResult.Err.Error()
+		} else if nodeResult.IsNodeDown && hasLease && probeResult.LeaseAge.Duration < d.policy.MinLeaseAge {
+			// The kubelet is still heartbeating so a failed probe is not trusted
+			klog.Warningf("node %s did not answer but renewed its lease %s ago", name, probeResult.LeaseAge.Duration)
+			probeResult.Error = fmt.Sprintf("lease renewed %s ago", probeResult.LeaseAge.Duration.Round(time.Second))
+		} else {
+			answered := !nodeResult.IsNodeDown
+			unreachable := h.add(answered, d.policy)
+			// Only a real answer vouches for a node, a failure still being
+			// confirmed or a node that answered but is still recovering is
+			// pending (an answer is never an accusation)
+			switch {
+			case answered && !unreachable:
+				probeResult.Reachable = true
+				klog.V(2).Infof("unready node still reachable %s", nodeResult.NetNode.IP)
+			case answered:
+				probeResult.Pending = true
+				klog.V(2).Infof("unready node answering but still recovering (pending) %s", nodeResult.NetNode.IP)
+			case !unreachable:
+				probeResult.Pending = true
+				klog.V(2).Infof("unready node not answering (pending) %s", nodeResult.NetNode.IP)
+			default:
+				klog.Warningf("unreachable node detected %s", nodeResult.NetNode.IP)
 			}
-			klog.V(2).Info("completed any reported on nodes down...")
+		}
+		probeResult.Window = h.snapshot()
+		probeResults = append(probeResults, probeResult)
+		klog.V(4).Infof("completed processing node result %d of %d", nodeIndex, len(checkableNodes))
+	}
+	klog.V(4).Infof("we have probe results for %d nodes", len(probeResults))
+	// Report on all checked nodes together (or that none are unready):
+	if err := d.report(probeResults); err != nil {
+		klog.Errorf("problem reporting unreachable nodes: %s", err)
+	}
+	klog.V(2).Info("completed any reported on nodes down...")
+	return len(unreadyNodes.Items), nil
+}
+
+// report publishes the probe results along with the mesh view and topology of this node
+func (d *Detector) report(results []kubeutils.ProbeResult) error {
+	return kubeutils.ReportProbeResults(d.client, d.namespace, &kubeutils.Report{
+		Reporter:    d.nodeName,
+		ReporterIP:  d.hostIP,
+		LastChecked: d.clock.Now(),
+		Results:     results,
+		Mesh:        d.meshView(),
+		Topology:    d.topology(),
+	})
+}
+
+// topology returns the topology labels of this node
+// - returns nil when the node can't be read (the monitor falls back to the node labels)
+func (d *Detector) topology() map[string]string {
+	node, err := d.client.CoreV1().Nodes().Get(d.nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("not reporting topology: can't get node %s: %s", d.nodeName, err)
+		return nil
+	}
+	labels := d.policy.TopologyLabels
+	if len(labels) == 0 {
+		labels = kubeutils.DefaultTopologyLabels
+	}
+	return kubeutils.GetNodeTopology(node, labels)
+}
+
+// meshIP is the address peers send to (the first InternalIP of our node)
+// - falls back to the host ip if our node can't be read
+func (d *Detector) meshIP() string {
+	node, err := d.client.CoreV1().Nodes().Get(d.nodeName, metav1.GetOptions{})
+	if err == nil {
+		if ip, err := kubeutils.GetNodeInternalIP(node); err == nil {
+			return ip
 		}
 	}
+	klog.Errorf("mesh listening on the host ip %s: can't find the InternalIP of %s", d.hostIP, d.nodeName)
+	return d.hostIP
 }
 
-func isNodeDown(ip string) (bool, error) {
-	pinger, err := pinger.NewPinger(ip)
+// meshView updates the mesh members from the nodes and returns the current view
+// - returns nil when the mesh is disabled
+// - when the nodes can't be listed the last known members are kept
+func (d *Detector) meshView() []kubeutils.MeshPeer {
+	if d.mesh == nil {
+		return nil
+	}
+	nodes, err := d.client.CoreV1().Nodes().List(metav1.ListOptions{})
 	if err != nil {
-		return false, err
+		klog.Errorf("mesh keeping previous members: can't list nodes: %s", err)
+	} else {
+		ips := make(map[string]string)
+		for i := range nodes.Items {
+			if ip, err := kubeutils.GetNodeInternalIP(&nodes.Items[i]); err == nil {
+				ips[nodes.Items[i].Name] = ip
+			}
+		}
+		d.mesh.SetPeers(ips)
 	}
-	pinger.Timeout = pingTimeout
-	pinger.Count = pingCount
-	pinger.SetPrivileged(true)
-	pinger.Run()
-	if pinger.Statistics().PacketLoss == 100 {
-		// This is a dead node from here - indicate this to the cluster...
-		return true, nil
+	var view []kubeutils.MeshPeer
+	for _, p := range d.mesh.View() {
+		view = append(view, kubeutils.MeshPeer{
+			Node:     p.Node,
+			State:    p.State,
+			LastSeen: p.LastSeen,
+		})
 	}
-	return false, nil
+	return view
 }
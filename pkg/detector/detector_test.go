@@ -0,0 +1,152 @@
+package detector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "metal-pod-reaper-reports"
+
+var testStart = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testNode(name string, ready v1.ConditionStatus, ips ...string) *v1.Node {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}},
+		},
+	}
+	for _, ip := range ips {
+		node.Status.Addresses = append(node.Status.Addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: ip})
+	}
+	return node
+}
+
+// newTestDetector is node1 checking the objects (node1 is added as a Ready node)
+func newTestDetector(probe ProbeFunc, policy ProbePolicy, objects ...runtime.Object) (*Detector, *fake.Clientset, *clock.FakeClock) {
+	objects = append(objects, testNode("node1", v1.ConditionTrue, "10.0.0.1"))
+	client := fake.NewSimpleClientset(objects...)
+	fakeClock := clock.NewFakeClock(testStart)
+	return NewForClient(client, probe, fakeClock, testNamespace, "node1", "10.0.0.1", policy), client, fakeClock
+}
+
+// probeDown is a probe where only the addresses in down are down
+func probeDown(down map[string]bool) ProbeFunc {
+	return func(ip string) (bool, error) {
+		return down[ip], nil
+	}
+}
+
+// check runs a round and returns the published result for a node
+func check(t *testing.T, d *Detector, client *fake.Clientset, node string) kubeutils.ProbeResult {
+	t.Helper()
+	if _, err := d.Check(); err != nil {
+		t.Fatal(err)
+	}
+	reports, err := kubeutils.GetReports(client, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reports {
+		if r.Reporter != d.nodeName {
+			continue
+		}
+		for _, p := range r.Results {
+			if p.Node == node {
+				return p
+			}
+		}
+	}
+	t.Fatalf("expected a result for %s", node)
+	return kubeutils.ProbeResult{}
+}
+
+func TestCheckRecoveringIsPending(t *testing.T) {
+	down := map[string]bool{"10.0.0.3": true}
+	d, client, _ := newTestDetector(probeDown(down), ProbePolicy{UnreachableAfter: 2, ReachableAfter: 2},
+		testNode("node3", v1.ConditionUnknown, "10.0.0.3"))
+
+	if p := check(t, d, client, "node3"); !p.Pending || p.IsUnreachable() {
+		t.Fatalf("expected a single failed round to be pending, got %+v", p)
+	}
+	if p := check(t, d, client, "node3"); !p.IsUnreachable() {
+		t.Fatalf("expected node3 to be unreachable, got %+v", p)
+	}
+
+	// Answering again but still recovering is never an accusation
+	down["10.0.0.3"] = false
+	if p := check(t, d, client, "node3"); !p.Pending || p.IsUnreachable() || p.Reachable {
+		t.Fatalf("expected a recovering node to be pending, got %+v", p)
+	}
+	if p := check(t, d, client, "node3"); !p.Reachable {
+		t.Errorf("expected node3 to be reachable once recovered, got %+v", p)
+	}
+}
+
+func TestCheckExtraNetworks(t *testing.T) {
+	node3 := testNode("node3", v1.ConditionUnknown, "10.0.0.3")
+	node3.Annotations = map[string]string{
+		kubeutils.AnnotationStorageIP: "10.1.0.3",
+		kubeutils.AnnotationBMCIP:     "10.2.0.3",
+	}
+	// The storage network still answers but the cluster network and BMC don't
+	down := map[string]bool{"10.0.0.3": true, "10.2.0.3": true}
+	d, client, _ := newTestDetector(probeDown(down), ProbePolicy{UnreachableAfter: 1}, node3)
+
+	p := check(t, d, client, "node3")
+	if !p.IsUnreachable() {
+		t.Errorf("expected other networks not to change the verdict, got %+v", p)
+	}
+	if len(p.Addresses) != 1 || p.Addresses[0].IP != "10.0.0.3" {
+		t.Errorf("expected only the cluster address in addresses, got %v", p.Addresses)
+	}
+	expected := map[string]kubeutils.AddressResult{
+		kubeutils.NetworkStorage: {Network: kubeutils.NetworkStorage, IP: "10.1.0.3", Reachable: true},
+		kubeutils.NetworkBMC:     {Network: kubeutils.NetworkBMC, IP: "10.2.0.3"},
+	}
+	if len(p.Networks) != len(expected) {
+		t.Fatalf("expected %d networks, got %v", len(expected), p.Networks)
+	}
+	for _, network := range p.Networks {
+		if network != expected[network.Network] {
+			t.Errorf("expected %+v, got %+v", expected[network.Network], network)
+		}
+	}
+}
+
+func TestCheckLeaseGate(t *testing.T) {
+	renewTime := metav1.NewMicroTime(testStart.Add(-10 * time.Second))
+	lease := &coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: "node3", Namespace: kubeutils.NodeLeaseNamespace},
+		Spec:       coordinationv1beta1.LeaseSpec{RenewTime: &renewTime},
+	}
+	down := map[string]bool{"10.0.0.3": true, "10.0.0.4": true}
+	d, client, fakeClock := newTestDetector(probeDown(down), ProbePolicy{UnreachableAfter: 1, MinLeaseAge: 40 * time.Second},
+		testNode("node3", v1.ConditionUnknown, "10.0.0.3"), testNode("node4", v1.ConditionUnknown, "10.0.0.4"), lease)
+
+	// node3 is still renewing its lease so the failed probe is not trusted
+	p := check(t, d, client, "node3")
+	if p.Error == "" || p.IsUnreachable() || len(p.Window) != 0 {
+		t.Fatalf("expected a failed probe with a recent lease not to count, got %+v", p)
+	}
+	if p.LeaseAge == nil || p.LeaseAge.Duration != 10*time.Second {
+		t.Errorf("expected the lease age to be reported, got %v", p.LeaseAge)
+	}
+	// node4 has no lease so only the probe counts
+	if p := check(t, d, client, "node4"); !p.IsUnreachable() || p.LeaseAge != nil {
+		t.Errorf("expected node4 without a lease to be unreachable, got %+v", p)
+	}
+
+	fakeClock.Step(30 * time.Second)
+	if p := check(t, d, client, "node3"); !p.IsUnreachable() || p.Error != "" {
+		t.Errorf("expected node3 to be unreachable once the lease is old enough, got %+v", p)
+	}
+}
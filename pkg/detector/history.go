@@ -0,0 +1,124 @@
+package detector
+
+import (
+	"fmt"
+	"time"
+)
+
+// HistorySize is the number of probe rounds kept for each target, so the most
+// UnreachableAfter and ReachableAfter can be
+const HistorySize = 10
+
+const (
+	// AddressPolicyAllFail a node is only down when every address fails
+	AddressPolicyAllFail = "all-fail"
+	// AddressPolicyAnyFail a node is down when any address fails
+	AddressPolicyAnyFail = "any-fail"
+)
+
+// ProbePolicy controls how probe results become a verdict on a node
+type ProbePolicy struct {
+	// AddressPolicy is how the results for each address of a node are combined
+	// (AddressPolicyAllFail when empty)
+	AddressPolicy string
+	// ICMP is the type of ICMP socket to probe with (ICMPAuto when empty)
+	ICMP string
+	// Parallelism is the most probes run at once (defaultParallelism when zero)
+	Parallelism int
+	// Timeout is how long to wait for each target to answer (defaultPingTimeout when zero)
+	Timeout time.Duration
+	// Interval is the time between probe rounds before jitter (defaultInterval when zero)
+	Interval time.Duration
+	// MeshPort is the UDP port for the heartbeat mesh between detectors (zero disables)
+	MeshPort int
+	// MinLeaseAge is how long ago the node Lease must have been renewed before
+	// a failed probe counts against a node (zero disables)
+	MinLeaseAge time.Duration
+	// TopologyLabels are the labels of this node recorded in its reports
+	// (kubeutils.DefaultTopologyLabels when empty)
+	TopologyLabels []string
+	// UnreachableAfter is the number of consecutive failed rounds before a
+	// node is reported unreachable (zero is the same as one, see ValidRounds)
+	UnreachableAfter int
+	// ReachableAfter is the number of consecutive successful rounds before an
+	// unreachable node is reported reachable again (zero is the same as one,
+	// see ValidRounds)
+	ReachableAfter int
+}
+
+// history is the rolling window of probe rounds for a single target
+type history struct {
+	// window of results, oldest first (true is reachable)
+	window      []bool
+	unreachable bool
+}
+
+// add records a probe round and returns if the node is now considered unreachable
+func (h *history) add(reachable bool, policy ProbePolicy) bool {
+	h.window = append(h.window, reachable)
+	if len(h.window) > HistorySize {
+		h.window = h.window[len(h.window)-HistorySize:]
+	}
+	run := h.run(reachable)
+	switch {
+	case !h.unreachable && !reachable && run >= atLeastOne(policy.UnreachableAfter):
+		h.unreachable = true
+	case h.unreachable && reachable && run >= atLeastOne(policy.ReachableAfter):
+		h.unreachable = false
+	}
+	return h.unreachable
+}
+
+// run counts the most recent consecutive rounds with the given result
+func (h *history) run(reachable bool) int {
+	count := 0
+	for i := len(h.window) - 1; i >= 0 && h.window[i] == reachable; i-- {
+		count++
+	}
+	return count
+}
+
+// snapshot returns a copy of the window suitable for a report
+func (h *history) snapshot() []bool {
+	return append([]bool(nil), h.window...)
+}
+
+// ValidRounds checks UnreachableAfter and ReachableAfter are between 1 and
+// HistorySize (more rounds than are kept could never be seen)
+func (p ProbePolicy) ValidRounds() error {
+	if p.UnreachableAfter < 1 || p.UnreachableAfter > HistorySize {
+		return fmt.Errorf("expecting unreachable-after between 1 and %d not %d", HistorySize, p.UnreachableAfter)
+	}
+	if p.ReachableAfter < 1 || p.ReachableAfter > HistorySize {
+		return fmt.Errorf("expecting reachable-after between 1 and %d not %d", HistorySize, p.ReachableAfter)
+	}
+	return nil
+}
+
+func (p ProbePolicy) parallelism() int {
+	if p.Parallelism < 1 {
+		return defaultParallelism
+	}
+	return p.Parallelism
+}
+
+func (p ProbePolicy) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return defaultPingTimeout
+	}
+	return p.Timeout
+}
+
+func (p ProbePolicy) interval() time.Duration {
+	if p.Interval <= 0 {
+		return defaultInterval
+	}
+	return p.Interval
+}
+
+func atLeastOne(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
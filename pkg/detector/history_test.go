@@ -0,0 +1,107 @@
+package detector
+
+import "testing"
+
+// rounds returns n probe rounds all with the same result
+func rounds(n int, reachable bool) []bool {
+	r := make([]bool, n)
+	for i := range r {
+		r[i] = reachable
+	}
+	return r
+}
+
+func TestHistoryAdd(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      ProbePolicy
+		rounds      []bool
+		unreachable bool
+	}{
+		{
+			name:        "one failure with unreachable-after 1",
+			policy:      ProbePolicy{UnreachableAfter: 1},
+			rounds:      rounds(1, false),
+			unreachable: true,
+		},
+		{
+			name:        "zero is the same as one",
+			rounds:      rounds(1, false),
+			unreachable: true,
+		},
+		{
+			name:   "one short of unreachable-after",
+			policy: ProbePolicy{UnreachableAfter: HistorySize},
+			rounds: rounds(HistorySize-1, false),
+		},
+		{
+			name:        "unreachable-after the whole window",
+			policy:      ProbePolicy{UnreachableAfter: HistorySize},
+			rounds:      rounds(HistorySize, false),
+			unreachable: true,
+		},
+		{
+			name:   "failures broken by an answer",
+			policy: ProbePolicy{UnreachableAfter: 2},
+			rounds: []bool{false, true, false},
+		},
+		{
+			name:        "one short of reachable-after",
+			policy:      ProbePolicy{UnreachableAfter: 1, ReachableAfter: HistorySize},
+			rounds:      append(rounds(1, false), rounds(HistorySize-1, true)...),
+			unreachable: true,
+		},
+		{
+			name:   "reachable-after the whole window",
+			policy: ProbePolicy{UnreachableAfter: 1, ReachableAfter: HistorySize},
+			rounds: append(rounds(1, false), rounds(HistorySize, true)...),
+		},
+		{
+			name:        "window longer than kept",
+			policy:      ProbePolicy{UnreachableAfter: HistorySize},
+			rounds:      append(rounds(5, true), rounds(HistorySize+5, false)...),
+			unreachable: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &history{}
+			var unreachable bool
+			for _, reachable := range test.rounds {
+				unreachable = h.add(reachable, test.policy)
+			}
+			if unreachable != test.unreachable {
+				t.Errorf("expected unreachable=%t, got %t", test.unreachable, unreachable)
+			}
+			size := len(test.rounds)
+			if size > HistorySize {
+				size = HistorySize
+			}
+			if len(h.snapshot()) != size {
+				t.Errorf("expected a window of %d rounds, got %d", size, len(h.snapshot()))
+			}
+		})
+	}
+}
+
+func TestProbePolicyValidRounds(t *testing.T) {
+	tests := []struct {
+		unreachableAfter, reachableAfter int
+		valid                            bool
+	}{
+		{unreachableAfter: 1, reachableAfter: 1, valid: true},
+		{unreachableAfter: HistorySize, reachableAfter: HistorySize, valid: true},
+		{unreachableAfter: 0, reachableAfter: 1},
+		{unreachableAfter: -1, reachableAfter: 1},
+		{unreachableAfter: HistorySize + 1, reachableAfter: 1},
+		{unreachableAfter: 1, reachableAfter: 0},
+		{unreachableAfter: 1, reachableAfter: HistorySize + 1},
+	}
+	for _, test := range tests {
+		policy := ProbePolicy{UnreachableAfter: test.unreachableAfter, ReachableAfter: test.reachableAfter}
+		if err := policy.ValidRounds(); (err == nil) != test.valid {
+			t.Errorf("unreachable-after %d reachable-after %d: expected valid=%t, got %v",
+				test.unreachableAfter, test.reachableAfter, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package detector
+
+import (
+	"fmt"
+	"time"
+
+	pinger "github.com/sparrc/go-ping"
+	"golang.org/x/net/icmp"
+	"k8s.io/klog"
+)
+
+const (
+	// ICMPAuto uses raw sockets when permitted and falls back to datagram sockets
+	ICMPAuto = "auto"
+	// ICMPPrivileged uses raw ICMP sockets (needs NET_RAW)
+	ICMPPrivileged = "privileged"
+	// ICMPUnprivileged uses ICMP datagram sockets (needs the group in net.ipv4.ping_group_range)
+	ICMPUnprivileged = "unprivileged"
+)
+
+// IsValidICMPMode is true for a known ICMP mode
+func IsValidICMPMode(mode string) bool {
+	return mode == "" || mode == ICMPAuto || mode == ICMPPrivileged || mode == ICMPUnprivileged
+}
+
+// newPingProbe returns a probe using the ICMP sockets allowed for the mode
+// - each target is given timeout to answer whatever the number of pings
+// - go-ping reports 100% packet loss when it can't open a socket so the socket is
+// checked here first, making a missing capability an error not an accusation
+func newPingProbe(mode string, timeout time.Duration) (ProbeFunc, error) {
+	var privileged bool
+	switch mode {
+	case ICMPPrivileged:
+		if err := checkICMPSocket(true); err != nil {
+			return nil, err
+		}
+		privileged = true
+	case ICMPUnprivileged:
+		if err := checkICMPSocket(false); err != nil {
+			return nil, err
+		}
+	default:
+		if err := checkICMPSocket(true); err == nil {
+			privileged = true
+		} else if err := checkICMPSocket(false); err != nil {
+			return nil, fmt.Errorf("no ICMP sockets available, need NET_RAW or net.ipv4.ping_group_range to include our group: %s", err)
+		}
+	}
+	klog.Infof("probing with ICMP (privileged=%t)", privileged)
+	return func(ip string) (bool, error) {
+		return isNodeDown(ip, privileged, timeout)
+	}, nil
+}
+
+// checkICMPSocket makes sure an ICMP socket can be opened
+func checkICMPSocket(privileged bool) error {
+	network := "udp4"
+	if privileged {
+		network = "ip4:icmp"
+	}
+	conn, err := icmp.ListenPacket(network, "0.0.0.0")
+	if err != nil {
+		return fmt.Errorf("can't open ICMP socket (privileged=%t): %s", privileged, err)
+	}
+	return conn.Close()
+}
+
+func isNodeDown(ip string, privileged bool, timeout time.Duration) (bool, error) {
+	pinger, err := pinger.NewPinger(ip)
+	if err != nil {
+		return false, err
+	}
+	pinger.Timeout = timeout
+	pinger.Count = pingCount
+	// Spread the pings over the timeout (at most a second apart)
+	if interval := timeout / pingCount; interval < pinger.Interval {
+		pinger.Interval = interval
+	}
+	pinger.SetPrivileged(privileged)
+	pinger.Run()
+	stats := pinger.Statistics()
+	if stats.PacketsSent == 0 {
+		return false, fmt.Errorf("no packets sent to %s", ip)
+	}
+	if stats.PacketLoss == 100 {
+		// This is a dead node from here - indicate this to the cluster...
+		return true, nil
+	}
+	return false, nil
+}
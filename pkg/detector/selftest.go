@@ -0,0 +1,63 @@
+package detector
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	selfTestLocalhost = "127.0.0.1"
+	selfTestRetry     = 30 * time.Second
+)
+
+// SelfTest checks probing works before any reports are published
+// - the local host and our own host ip must answer
+// - at least one Ready peer must answer (when there are any)
+func (d *Detector) SelfTest() error {
+	for _, ip := range []string{selfTestLocalhost, d.hostIP} {
+		if err := d.selfTestProbe(ip); err != nil {
+			return err
+		}
+	}
+	nodes, err := d.client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("can't list nodes: %s", err)
+	}
+	var lastErr error
+	peers := 0
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if node.Name == d.nodeName || !kubeutils.IsNodeReady(node) {
+			continue
+		}
+		ip, err := kubeutils.GetNodeInternalIP(node)
+		if err != nil {
+			continue
+		}
+		peers++
+		if lastErr = d.selfTestProbe(ip); lastErr == nil {
+			klog.Infof("self test passed (peer %s at %s)", node.Name, ip)
+			return nil
+		}
+	}
+	if peers == 0 {
+		klog.Info("self test passed (no Ready peers to probe)")
+		return nil
+	}
+	return fmt.Errorf("no Ready peer could be probed: %s", lastErr)
+}
+
+func (d *Detector) selfTestProbe(ip string) error {
+	down, err := d.probe(ip)
+	if err != nil {
+		return fmt.Errorf("error probing %s: %s", ip, err)
+	}
+	if down {
+		return fmt.Errorf("known good address %s did not answer", ip)
+	}
+	return nil
+}
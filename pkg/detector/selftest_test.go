@@ -0,0 +1,58 @@
+package detector
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestSelfTest(t *testing.T) {
+	peers := []*v1.Node{
+		testNode("node2", v1.ConditionTrue, "10.0.0.2"),
+		testNode("node3", v1.ConditionTrue, "10.0.0.3"),
+		testNode("node4", v1.ConditionUnknown, "10.0.0.4"),
+	}
+	tests := []struct {
+		name     string
+		outcomes map[string]string
+		noPeers  bool
+		passed   bool
+	}{
+		{
+			name:     "localhost and a peer answer",
+			outcomes: map[string]string{selfTestLocalhost: "up", "10.0.0.1": "up", "10.0.0.3": "up"},
+			passed:   true,
+		},
+		{
+			name:     "localhost does not answer",
+			outcomes: map[string]string{selfTestLocalhost: "down", "10.0.0.1": "up", "10.0.0.2": "up", "10.0.0.3": "up"},
+		},
+		{
+			name:     "host ip can't be probed",
+			outcomes: map[string]string{selfTestLocalhost: "up", "10.0.0.2": "up", "10.0.0.3": "up"},
+		},
+		{
+			name:     "no Ready peer answers",
+			outcomes: map[string]string{selfTestLocalhost: "up", "10.0.0.1": "up", "10.0.0.2": "down", "10.0.0.4": "up"},
+		},
+		{
+			name:     "no Ready peers",
+			outcomes: map[string]string{selfTestLocalhost: "up", "10.0.0.1": "up"},
+			noPeers:  true,
+			passed:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var d *Detector
+			if test.noPeers {
+				d, _, _ = newTestDetector(probeOutcomes(test.outcomes), ProbePolicy{}, peers[2])
+			} else {
+				d, _, _ = newTestDetector(probeOutcomes(test.outcomes), ProbePolicy{}, peers[0], peers[1], peers[2])
+			}
+			if err := d.SelfTest(); (err == nil) != test.passed {
+				t.Errorf("expected passed=%t, got %v", test.passed, err)
+			}
+		})
+	}
+}
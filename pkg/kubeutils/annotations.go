@@ -0,0 +1,119 @@
+package kubeutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+const (
+	// AnnotationPrefix is used for all annotations owned by mpodr
+	AnnotationPrefix = "mpodr.appvia.io/"
+	// AnnotationFenced is set on a Node (by a fencing agent or an operator) once
+	// the machine is confirmed to be powered off or isolated from storage
+	AnnotationFenced = AnnotationPrefix + "fenced"
+	// AnnotationReapedAt is set on a Node by the monitor once all its pods have been reaped
+	AnnotationReapedAt = AnnotationPrefix + "reaped-at"
+	// AnnotationManualReapBy records the kubernetes user who ran a manual reap of a Node
+	AnnotationManualReapBy = AnnotationPrefix + "manual-reap-by"
+	// AnnotationManualReapNote is the note given with a manual reap (not verified)
+	AnnotationManualReapNote = AnnotationPrefix + "manual-reap-note"
+	// AnnotationStorageIP is the address of a Node on a dedicated storage network
+	AnnotationStorageIP = AnnotationPrefix + "storage-ip"
+	// AnnotationBMCIP is the address of the management controller (BMC) of a Node
+	AnnotationBMCIP = AnnotationPrefix + "bmc-ip"
+	// AnnotationEvictionRefusedAt is set on a Pod when its eviction is first
+	// refused (e.g. by a PodDisruptionBudget) so the eviction timeout can be measured
+	AnnotationEvictionRefusedAt = AnnotationPrefix + "eviction-refused-at"
+
+	// NetworkStorage is the name of the storage network in probe results
+	NetworkStorage = "storage"
+	// NetworkBMC is the name of the management network in probe results
+	NetworkBMC = "bmc"
+)
+
+// ExtraTarget is an address of a node on a network other than the cluster network
+type ExtraTarget struct {
+	Network string
+	IP      string
+}
+
+// GetNodeExtraTargets returns the addresses annotated on a node for other networks
+func GetNodeExtraTargets(node *v1.Node) []ExtraTarget {
+	var targets []ExtraTarget
+	if ip := node.Annotations[AnnotationStorageIP]; ip != "" {
+		targets = append(targets, ExtraTarget{Network: NetworkStorage, IP: ip})
+	}
+	if ip := node.Annotations[AnnotationBMCIP]; ip != "" {
+		targets = append(targets, ExtraTarget{Network: NetworkBMC, IP: ip})
+	}
+	return targets
+}
+
+// IsNodeFenced reports if a node has been confirmed as fenced
+// - the annotation must be "true" or the RFC3339 time it was fenced, anything
+// else (including "false" or empty) is not fenced
+func IsNodeFenced(node *v1.Node) bool {
+	value := node.Annotations[AnnotationFenced]
+	if value == "true" {
+		return true
+	}
+	_, err := time.Parse(time.RFC3339, value)
+	return err == nil
+}
+
+// GetNodeReapedAt returns when the node was reaped during its current NotReady period
+// - a reap recorded before the node last went NotReady is ignored
+func GetNodeReapedAt(node *v1.Node) (time.Time, bool) {
+	since, ok := GetNodeNotReadySince(node)
+	if !ok {
+		return time.Time{}, false
+	}
+	reapedAt, err := time.Parse(time.RFC3339, node.Annotations[AnnotationReapedAt])
+	if err != nil || reapedAt.Before(since) {
+		return time.Time{}, false
+	}
+	return reapedAt, true
+}
+
+// AnnotateNode sets (or with an empty value removes) a single annotation on a node
+func AnnotateNode(c clientset.Interface, nodeName, key, value string) error {
+	patch, err := annotationPatch(key, value)
+	if err != nil {
+		return err
+	}
+	if _, err := c.CoreV1().Nodes().Patch(nodeName, types.StrategicMergePatchType, patch); err != nil {
+		return fmt.Errorf("error annotating node %s with %s: %s", nodeName, key, err)
+	}
+	return nil
+}
+
+// AnnotatePod sets (or with an empty value removes) a single annotation on a pod
+func AnnotatePod(c clientset.Interface, namespace, name, key, value string) error {
+	patch, err := annotationPatch(key, value)
+	if err != nil {
+		return err
+	}
+	if _, err := c.CoreV1().Pods(namespace).Patch(name, types.StrategicMergePatchType, patch); err != nil {
+		return fmt.Errorf("error annotating pod %s/%s with %s: %s", namespace, name, key, err)
+	}
+	return nil
+}
+
+func annotationPatch(key, value string) ([]byte, error) {
+	var patchValue interface{}
+	if value != "" {
+		patchValue = value
+	}
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				key: patchValue,
+			},
+		},
+	})
+}
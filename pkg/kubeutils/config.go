@@ -1,12 +1,24 @@
 package kubeutils
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// BuildConfig returns the client config from KUBECONFIG, in cluster or
+// (for commands run from a workstation) ~/.kube/config
 func BuildConfig() (*rest.Config, error) {
 	kubeconfig := os.Getenv("KUBECONFIG")
 	if kubeconfig != "" {
@@ -19,7 +31,99 @@ func BuildConfig() (*rest.Config, error) {
 
 	cfg, err := rest.InClusterConfig()
 	if err != nil {
-		return nil, err
+		home, _ := os.UserHomeDir()
+		kubeconfig = filepath.Join(home, ".kube", "config")
+		if _, statErr := os.Stat(kubeconfig); statErr != nil {
+			return nil, err
+		}
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
 	}
 	return cfg, nil
 }
+
+// selfSubjectReview is the part of an authentication.k8s.io SelfSubjectReview
+// we need (the type is newer than this client)
+type selfSubjectReview struct {
+	Status struct {
+		UserInfo struct {
+			Username string `json:"username"`
+		} `json:"userInfo"`
+	} `json:"status"`
+}
+
+// WhoAmI returns the user a client config is authenticated as
+// - asks the API server with a SelfSubjectReview (kubernetes 1.27 and later)
+// - otherwise falls back to the client certificate's common name, the basic
+// auth user or the user of the current kubeconfig context
+func WhoAmI(cfg *rest.Config) (string, error) {
+	for _, version := range []string{"v1", "v1beta1"} {
+		user, err := selfSubjectReviewUser(cfg, version)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.IsNotFound(err) {
+			return "", fmt.Errorf("error reviewing own identity: %s", err)
+		}
+	}
+	if user, err := certCommonName(cfg); err != nil {
+		return "", err
+	} else if user != "" {
+		return user, nil
+	}
+	if cfg.Username != "" {
+		return cfg.Username, nil
+	}
+	raw, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).RawConfig()
+	if err == nil {
+		if context, ok := raw.Contexts[raw.CurrentContext]; ok && context.AuthInfo != "" {
+			return context.AuthInfo, nil
+		}
+	}
+	return "", fmt.Errorf("can't identify the user of the client config")
+}
+
+func selfSubjectReviewUser(cfg *rest.Config, version string) (string, error) {
+	config := rest.CopyConfig(cfg)
+	config.GroupVersion = &schema.GroupVersion{Group: "authentication.k8s.io", Version: version}
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+	client, err := rest.RESTClientFor(config)
+	if err != nil {
+		return "", err
+	}
+	body := fmt.Sprintf(`{"apiVersion":"authentication.k8s.io/%s","kind":"SelfSubjectReview"}`, version)
+	b, err := client.Post().Resource("selfsubjectreviews").Body([]byte(body)).Do().Raw()
+	if err != nil {
+		return "", err
+	}
+	var review selfSubjectReview
+	if err := json.Unmarshal(b, &review); err != nil {
+		return "", fmt.Errorf("error decoding self subject review: %s", err)
+	}
+	if review.Status.UserInfo.Username == "" {
+		return "", fmt.Errorf("self subject review has no username")
+	}
+	return review.Status.UserInfo.Username, nil
+}
+
+// certCommonName returns the common name of the client certificate (empty when there is none)
+func certCommonName(cfg *rest.Config) (string, error) {
+	data := cfg.CertData
+	if len(data) == 0 && cfg.CertFile != "" {
+		b, err := ioutil.ReadFile(cfg.CertFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading client certificate: %s", err)
+		}
+		data = b
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("error parsing client certificate: %s", err)
+	}
+	return cert.Subject.CommonName, nil
+}
@@ -0,0 +1,74 @@
+package kubeutils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+// reviewServer answers SelfSubjectReviews for version with review (or status when it is not 200)
+func reviewServer(version string, status int, review string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/apis/authentication.k8s.io/"+version+"/selfsubjectreviews" || status != http.StatusOK {
+			code := status
+			if code == http.StatusOK {
+				code = http.StatusNotFound
+			}
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(review))
+	}))
+}
+
+func TestWhoAmI(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	err := ioutil.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+current-context: ops
+contexts:
+- name: ops
+  context:
+    cluster: metal
+    user: ops-admin
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBECONFIG", kubeconfig)
+
+	review := `{"apiVersion":"authentication.k8s.io/v1","kind":"SelfSubjectReview","status":{"userInfo":{"username":"alice@example.com"}}}`
+	tests := []struct {
+		name     string
+		version  string
+		status   int
+		username string
+		expected string
+		err      bool
+	}{
+		{name: "self subject review", version: "v1", status: http.StatusOK, expected: "alice@example.com"},
+		{name: "beta self subject review", version: "v1beta1", status: http.StatusOK, expected: "alice@example.com"},
+		{name: "review trusted over the basic auth user", version: "v1", status: http.StatusOK, username: "admin", expected: "alice@example.com"},
+		{name: "basic auth user without reviews", status: http.StatusNotFound, username: "admin", expected: "admin"},
+		{name: "kubeconfig user without reviews", status: http.StatusNotFound, expected: "ops-admin"},
+		{name: "review refused", status: http.StatusUnauthorized, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := reviewServer(test.version, test.status, review)
+			defer server.Close()
+			user, err := WhoAmI(&rest.Config{Host: server.URL, Username: test.username})
+			if (err != nil) != test.err {
+				t.Fatalf("expected err=%t, got %v", test.err, err)
+			}
+			if user != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, user)
+			}
+		})
+	}
+}
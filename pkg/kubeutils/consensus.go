@@ -0,0 +1,307 @@
+package kubeutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// Report is a single detector's view of the nodes it cannot reach
+type Report struct {
+	// Name of the object holding the report
+	Name string
+	// Reporter is the name of the reporting node
+	Reporter string
+	// ReporterIP is the ip the reporting node probed from
+	ReporterIP  string
+	LastChecked time.Time
+	Unreachable []string
+	// Results of every target probed (empty for reports from older versions)
+	Results []ProbeResult
+	// Mesh is the reporter's view of the heartbeat mesh (empty when disabled)
+	Mesh []MeshPeer
+	// Topology is the reporter's topology labels (empty when it has none)
+	Topology map[string]string
+}
+
+// MeshPeer is a reporter's view of another member of the heartbeat mesh
+type MeshPeer struct {
+	Node     string    `json:"node"`
+	State    string    `json:"state"`
+	LastSeen time.Time `json:"lastSeen,omitempty"`
+}
+
+// MeshStateAlive is the state of a mesh peer that answered its last heartbeat
+const MeshStateAlive = "alive"
+
+// ProbeResult is the outcome of a detector probing a single node
+type ProbeResult struct {
+	Node string `json:"node"`
+	IP   string `json:"ip"`
+	// Reachable is only set when the node answered this round and is not
+	// recovering from being unreachable
+	Reachable bool `json:"reachable"`
+	// Pending is set when the node did not answer but has not failed enough
+	// rounds to be reported unreachable, or answered but has not recovered for
+	// enough rounds to be reported reachable (neither a vouch nor an accusation)
+	Pending bool      `json:"pending,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+	// LeaseAge is how long ago the kubelet last renewed the node Lease
+	LeaseAge *metav1.Duration `json:"leaseAge,omitempty"`
+	// Window is the recent probe rounds the verdict is based on, oldest first
+	Window []bool `json:"window,omitempty"`
+	// Addresses are the results for each address probed this round
+	Addresses []AddressResult `json:"addresses,omitempty"`
+	// Networks are the results for addresses on other networks (e.g. storage)
+	// - these are checked independently and don't change Reachable
+	Networks []AddressResult `json:"networks,omitempty"`
+}
+
+// AddressResult is the outcome of probing a single address of a node
+type AddressResult struct {
+	// Network is set for addresses that are not on the cluster network
+	Network   string `json:"network,omitempty"`
+	IP        string `json:"ip"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// IsUnreachable is true when the probe worked and the node is reported unreachable
+// - a pending failure is not yet an accusation
+func (p ProbeResult) IsUnreachable() bool {
+	return !p.Reachable && !p.Pending && p.Error == ""
+}
+
+// NodeConsensus is what the reporters, taken together, say about a NotReady node
+type NodeConsensus struct {
+	Node     *v1.Node `json:"-"`
+	NodeName string   `json:"node"`
+	Agreeing []string `json:"agreeing"`
+	// Disagreeing reporters could reach the node - any one is a veto
+	Disagreeing []string `json:"disagreeing"`
+	// Unchecked reporters have a fresh report that did not check the node
+	Unchecked []string `json:"unchecked"`
+	Stale     []string `json:"stale"`
+	// Domain is the failure domain of the node (empty when unknown)
+	Domain string `json:"domain,omitempty"`
+	// CrossDomain are the agreeing reporters in a different failure domain
+	CrossDomain []string `json:"crossDomain,omitempty"`
+	// Quorum is the number of agreeing reporters needed
+	Quorum      int  `json:"quorum"`
+	Unreachable bool `json:"unreachable"`
+}
+
+// ParseReport decodes a report written by ReportProbeResults
+func ParseReport(cm *v1.ConfigMap) (*Report, error) {
+	reportTimeStr := cm.Data[configMapKeyLastChecked]
+	reportTime, err := time.Parse(time.RFC3339, reportTimeStr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse datetime value %s in configmap %s error=%s", reportTimeStr, cm.Name, err)
+	}
+	r := &Report{
+		Name:        cm.Name,
+		Reporter:    cm.Data[configMapKeyCheckedBy],
+		ReporterIP:  cm.Data[configMapKeyCheckedByIP],
+		LastChecked: reportTime,
+	}
+	// Older reports only have the ip of the reporter
+	if r.Reporter == "" {
+		r.Reporter = r.ReporterIP
+	}
+	if r.Reporter == "" {
+		r.Reporter = cm.Name
+	}
+	for _, nodeName := range strings.Split(cm.Data[configMapKeyUnreachableNodes], ",") {
+		if nodeName != "" {
+			r.Unreachable = append(r.Unreachable, nodeName)
+		}
+	}
+	if results := cm.Data[configMapKeyProbeResults]; results != "" {
+		if err := json.Unmarshal([]byte(results), &r.Results); err != nil {
+			return nil, fmt.Errorf("cannot parse probe results in configmap %s error=%s", cm.Name, err)
+		}
+	}
+	if mesh := cm.Data[configMapKeyMeshView]; mesh != "" {
+		if err := json.Unmarshal([]byte(mesh), &r.Mesh); err != nil {
+			return nil, fmt.Errorf("cannot parse mesh view in configmap %s error=%s", cm.Name, err)
+		}
+	}
+	if topology := cm.Data[configMapKeyTopology]; topology != "" {
+		if err := json.Unmarshal([]byte(topology), &r.Topology); err != nil {
+			return nil, fmt.Errorf("cannot parse topology in configmap %s error=%s", cm.Name, err)
+		}
+	}
+	return r, nil
+}
+
+// IsStale is true when a report is too old to be counted
+func (r *Report) IsStale(now time.Time) bool {
+	return now.Sub(r.LastChecked) > configMapValidFor
+}
+
+// Vouches is true if the report has positive evidence the node is reachable
+// - either a probe or the heartbeat mesh reached the node
+// - a pending probe failure is not evidence either way
+func (r *Report) Vouches(nodeName string) bool {
+	for _, p := range r.Results {
+		if p.Node == nodeName && p.Reachable {
+			return true
+		}
+	}
+	for _, p := range r.Mesh {
+		if p.Node == nodeName && p.State == MeshStateAlive && r.LastChecked.Sub(p.LastSeen) <= configMapValidFor {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPending is true if the report has failed probes for the node that are not yet an accusation
+func (r *Report) IsPending(nodeName string) bool {
+	for _, p := range r.Results {
+		if p.Node == nodeName && p.Pending {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkResult returns the result for a node on another network (if probed)
+func (r *Report) NetworkResult(nodeName, network string) (AddressResult, bool) {
+	for _, p := range r.Results {
+		if p.Node != nodeName {
+			continue
+		}
+		for _, n := range p.Networks {
+			if n.Network == network {
+				return n, true
+			}
+		}
+	}
+	return AddressResult{}, false
+}
+
+// Accuses is true if the report lists the node as unreachable
+func (r *Report) Accuses(nodeName string) bool {
+	for _, n := range r.Unreachable {
+		if n == nodeName {
+			return true
+		}
+	}
+	return false
+}
+
+// GetReports returns all the reports in the namespace
+// - reports that can't be parsed are logged and discounted
+func GetReports(c clientset.Interface, namespace string) ([]*Report, error) {
+	// get ConfigMaps "reporting node Unreachable"
+	cmOptions := metav1.ListOptions{
+		LabelSelector: ReportSelector,
+	}
+	cmList, err := c.CoreV1().ConfigMaps(namespace).List(cmOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error getting configmaps: %s", err)
+	}
+	klog.V(4).Infof("got %d configmaps with matching labels", len(cmList.Items))
+	var reports []*Report
+	for i := range cmList.Items {
+		r, err := ParseReport(&cmList.Items[i])
+		if err != nil {
+			klog.Error(err)
+			// discount this report
+			continue
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+// GetConsensus reads all the reports and works out the consensus for every NotReady node
+func GetConsensus(c clientset.Interface, namespace string, policy ConsensusPolicy) ([]NodeConsensus, error) {
+	reports, err := GetReports(c, namespace)
+	if err != nil {
+		return nil, err
+	}
+	allNodes, err := c.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		// Maybe we should be retrying...?
+		return nil, fmt.Errorf("can't list nodes: %s", err)
+	}
+	return EvaluateConsensus(allNodes.Items, reports, policy, time.Now()), nil
+}
+
+// EvaluateConsensus works out which NotReady nodes a quorum agree are unreachable
+// - every Ready node is expected to report (a majority for QuorumCrossDomain)
+// - only reports fresher than configMapValidFor are counted
+// - a single report that could reach the node is a veto
+// - for QuorumCrossDomain one agreeing reporter must be in a different failure
+// domain to the node, so a single switch failure can't cause a reap (see InDifferentDomains)
+func EvaluateConsensus(allNodes []v1.Node, reports []*Report, policy ConsensusPolicy, now time.Time) []NodeConsensus {
+	labels := policy.labels()
+	var unreadyNodes []*v1.Node
+	nodeTopology := make(map[string]map[string]string)
+	for i := range allNodes {
+		if !IsNodeReady(&allNodes[i]) {
+			unreadyNodes = append(unreadyNodes, &allNodes[i])
+		}
+		nodeTopology[allNodes[i].Name] = GetNodeTopology(&allNodes[i], labels)
+	}
+	readyNodes := len(allNodes) - len(unreadyNodes)
+	reportingQuorum := policy.required(readyNodes)
+	klog.V(4).Infof("expecting results from %d of %d ready nodes", reportingQuorum, readyNodes)
+
+	var consensus []NodeConsensus
+	for _, node := range unreadyNodes {
+		nc := NodeConsensus{
+			Node:     node,
+			NodeName: node.Name,
+			Domain:   FailureDomain(nodeTopology[node.Name], labels),
+			Quorum:   reportingQuorum,
+		}
+		for _, r := range reports {
+			switch {
+			case r.IsStale(now):
+				nc.Stale = append(nc.Stale, r.Reporter)
+			case r.Vouches(node.Name):
+				nc.Disagreeing = append(nc.Disagreeing, r.Reporter)
+			case r.Accuses(node.Name):
+				nc.Agreeing = append(nc.Agreeing, r.Reporter)
+				// Reports from older versions have no topology so use the reporter's node
+				topology := r.Topology
+				if topology == nil {
+					topology = nodeTopology[r.Reporter]
+				}
+				if InDifferentDomains(topology, nodeTopology[node.Name], labels) {
+					nc.CrossDomain = append(nc.CrossDomain, r.Reporter)
+				}
+			default:
+				nc.Unchecked = append(nc.Unchecked, r.Reporter)
+			}
+		}
+		nc.Unreachable = len(nc.Disagreeing) == 0 && len(nc.Agreeing) > 0 && len(nc.Agreeing) >= reportingQuorum
+		if policy.Quorum == QuorumCrossDomain && len(nc.CrossDomain) == 0 {
+			nc.Unreachable = false
+		}
+		klog.V(4).Infof("%d nodes have reported %s as unreachable (quorum is %d)", len(nc.Agreeing), node.Name, reportingQuorum)
+		consensus = append(consensus, nc)
+	}
+	return consensus
+}
+
+// IsNodeReady is true when the node Ready condition is True
+func IsNodeReady(node *v1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	// No Ready condition - not counted as unready (same as GetUnreadyNodes)
+	return true
+}
@@ -0,0 +1,49 @@
+package kubeutils
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestEvaluateConsensusPendingIsNotAVeto(t *testing.T) {
+	now := time.Now()
+	nodes := []v1.Node{
+		topologyNode("node1", v1.ConditionTrue, nil),
+		topologyNode("node2", v1.ConditionTrue, nil),
+		topologyNode("node3", v1.ConditionFalse, nil),
+	}
+	report := func(reporter string, result ProbeResult) *Report {
+		result.Node = "node3"
+		r := &Report{
+			Reporter:    reporter,
+			LastChecked: now,
+			Results:     []ProbeResult{result},
+		}
+		if result.IsUnreachable() {
+			r.Unreachable = []string{"node3"}
+		}
+		return r
+	}
+
+	consensus := EvaluateConsensus(nodes, []*Report{
+		report("node1", ProbeResult{}),
+		report("node2", ProbeResult{Pending: true}),
+	}, ConsensusPolicy{}, now)
+	nc := consensus[0]
+	if len(nc.Disagreeing) != 0 {
+		t.Errorf("expected a pending failure not to veto, got disagreeing %v", nc.Disagreeing)
+	}
+	if len(nc.Agreeing) != 1 || len(nc.Unchecked) != 1 || nc.Unreachable {
+		t.Errorf("expected 1 agreeing and 1 unchecked without a quorum, got agreeing %v unchecked %v unreachable=%t", nc.Agreeing, nc.Unchecked, nc.Unreachable)
+	}
+
+	consensus = EvaluateConsensus(nodes, []*Report{
+		report("node1", ProbeResult{}),
+		report("node2", ProbeResult{Reachable: true}),
+	}, ConsensusPolicy{}, now)
+	if len(consensus[0].Disagreeing) != 1 || consensus[0].Unreachable {
+		t.Errorf("expected a reachable probe to veto, got disagreeing %v", consensus[0].Disagreeing)
+	}
+}
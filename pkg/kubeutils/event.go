@@ -0,0 +1,38 @@
+package kubeutils
+
+import (
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+// CreateNodeEvent records an Event against a node synchronously
+// - for short lived commands that can't wait for an event broadcaster to flush
+func CreateNodeEvent(c clientset.Interface, node *v1.Node, component, eventType, reason, message string) error {
+	now := metav1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", node.Name, now.UnixNano()),
+			Namespace: metav1.NamespaceDefault,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind: "Node",
+			Name: node.Name,
+			UID:  node.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: component},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := c.CoreV1().Events(metav1.NamespaceDefault).Create(event); err != nil {
+		return fmt.Errorf("error recording event for node %s: %s", node.Name, err)
+	}
+	return nil
+}
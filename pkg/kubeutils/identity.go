@@ -0,0 +1,98 @@
+package kubeutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+// ServiceAccountNamespaceFile holds the namespace of a pod's service account
+const ServiceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// GetNamespace returns the namespace this pod is running in
+func GetNamespace() (string, error) {
+	data, err := ioutil.ReadFile(ServiceAccountNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("error discovering namespace: %s", err)
+	}
+	namespace := strings.TrimSpace(string(data))
+	if namespace == "" {
+		return "", fmt.Errorf("error discovering namespace: %s is empty", ServiceAccountNamespaceFile)
+	}
+	return namespace, nil
+}
+
+// GetNodeIdentity works out the name and internal ip of the node we are running on
+// - a known node name (e.g. NODE_NAME from the downward API) is used as is
+// - otherwise the node with an address matching the host ip or a local interface is found
+// - when no host ip is given the node's internal ip is used
+func GetNodeIdentity(c clientset.Interface, nodeName, hostIP string) (string, string, error) {
+	var node *v1.Node
+	if nodeName != "" {
+		n, err := c.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			return "", "", fmt.Errorf("error getting node %s: %s", nodeName, err)
+		}
+		node = n
+	} else {
+		addresses := []string{hostIP}
+		if hostIP == "" {
+			local, err := LocalAddresses()
+			if err != nil {
+				return "", "", err
+			}
+			addresses = local
+		}
+		nodes, err := c.CoreV1().Nodes().List(metav1.ListOptions{})
+		if err != nil {
+			return "", "", fmt.Errorf("can't list nodes: %s", err)
+		}
+		node = findNodeByAddress(nodes.Items, addresses)
+		if node == nil {
+			return "", "", fmt.Errorf("no node has any of the addresses %v", addresses)
+		}
+	}
+	if hostIP == "" {
+		ip, err := GetNodeInternalIP(node)
+		if err != nil {
+			return "", "", err
+		}
+		hostIP = ip
+	}
+	return node.Name, hostIP, nil
+}
+
+// LocalAddresses returns the ip addresses of all the local interfaces (other than loopback)
+func LocalAddresses() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("error listing interface addresses: %s", err)
+	}
+	var addresses []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		addresses = append(addresses, ipNet.IP.String())
+	}
+	return addresses, nil
+}
+
+func findNodeByAddress(nodes []v1.Node, addresses []string) *v1.Node {
+	for i := range nodes {
+		for _, nodeAddress := range nodes[i].Status.Addresses {
+			for _, address := range addresses {
+				if nodeAddress.Address == address {
+					return &nodes[i]
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package kubeutils
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func identityNode(name string, addresses ...v1.NodeAddress) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     v1.NodeStatus{Addresses: addresses},
+	}
+}
+
+func internalIP(ip string) v1.NodeAddress {
+	return v1.NodeAddress{Type: v1.NodeInternalIP, Address: ip}
+}
+
+func TestGetNodeIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodeName string
+		hostIP   string
+		expected string
+		ip       string
+		err      bool
+	}{
+		{name: "node name", nodeName: "node2", expected: "node2", ip: "10.0.0.2"},
+		{name: "node name and host ip", nodeName: "node2", hostIP: "10.1.0.2", expected: "node2", ip: "10.1.0.2"},
+		{name: "unknown node name", nodeName: "node9", err: true},
+		{name: "host ip", hostIP: "10.0.0.3", expected: "node3", ip: "10.0.0.3"},
+		{name: "host ip of another address type", hostIP: "192.168.0.3", expected: "node3", ip: "192.168.0.3"},
+		{name: "host ip of no node", hostIP: "10.0.0.9", err: true},
+		{name: "node without an internal ip", nodeName: "node4", err: true},
+	}
+	client := fake.NewSimpleClientset(
+		identityNode("node2", internalIP("10.0.0.2")),
+		identityNode("node3", internalIP("10.0.0.3"), v1.NodeAddress{Type: v1.NodeExternalIP, Address: "192.168.0.3"}),
+		identityNode("node4", v1.NodeAddress{Type: v1.NodeHostName, Address: "node4"}),
+	)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, ip, err := GetNodeIdentity(client, test.nodeName, test.hostIP)
+			if (err != nil) != test.err {
+				t.Fatalf("expected err=%t, got %v", test.err, err)
+			}
+			if name != test.expected || ip != test.ip {
+				t.Errorf("expected %s %s, got %s %s", test.expected, test.ip, name, ip)
+			}
+		})
+	}
+}
+
+func TestGetNodeIdentityLocalAddresses(t *testing.T) {
+	local, err := LocalAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(local) == 0 {
+		t.Skip("no local interface addresses")
+	}
+	client := fake.NewSimpleClientset(
+		identityNode("node2", internalIP("203.0.113.2")),
+		identityNode("node3", internalIP("203.0.113.3"), v1.NodeAddress{Type: v1.NodeExternalIP, Address: local[0]}),
+	)
+	name, ip, err := GetNodeIdentity(client, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "node3" || ip != "203.0.113.3" {
+		t.Errorf("expected the node with a local address and its internal ip, got %s %s", name, ip)
+	}
+
+	client = fake.NewSimpleClientset(identityNode("node2", internalIP("203.0.113.2")))
+	if _, _, err := GetNodeIdentity(client, "", ""); err == nil {
+		t.Error("expected an error when no node has a local address")
+	}
+}
+
+func TestFindNodeByAddress(t *testing.T) {
+	nodes := []v1.Node{
+		*identityNode("node2", internalIP("10.0.0.2")),
+		*identityNode("node3", internalIP("10.0.0.3"), internalIP("10.1.0.3")),
+	}
+	tests := []struct {
+		name      string
+		addresses []string
+		expected  string
+	}{
+		{name: "first address", addresses: []string{"10.0.0.2"}, expected: "node2"},
+		{name: "second address of a node", addresses: []string{"10.1.0.3"}, expected: "node3"},
+		{name: "any of the addresses", addresses: []string{"172.17.0.1", "10.0.0.3"}, expected: "node3"},
+		{name: "no match", addresses: []string{"172.17.0.1"}},
+		{name: "no addresses"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := findNodeByAddress(nodes, test.addresses)
+			var name string
+			if node != nil {
+				name = node.Name
+			}
+			if name != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package kubeutils
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+// NodeLeaseNamespace holds the Lease each kubelet renews as a heartbeat
+const NodeLeaseNamespace = "kube-node-lease"
+
+// GetNodeLeases returns when the kubelet on each node last renewed its Lease
+// - nodes without a Lease (e.g. the NodeLease feature is disabled) are missing
+func GetNodeLeases(c clientset.Interface) (map[string]time.Time, error) {
+	renewed := make(map[string]time.Time)
+	leases, err := c.CoordinationV1beta1().Leases(NodeLeaseNamespace).List(metav1.ListOptions{})
+	if errors.IsNotFound(err) {
+		// no lease api on this cluster
+		return renewed, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing node leases: %s", err)
+	}
+	for _, lease := range leases.Items {
+		if lease.Spec.RenewTime != nil {
+			renewed[lease.Name] = lease.Spec.RenewTime.Time
+		}
+	}
+	return renewed, nil
+}
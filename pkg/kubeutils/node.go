@@ -1,6 +1,7 @@
 package kubeutils
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -16,16 +17,28 @@ const (
 	nodeConfigMapNamePrefix      = "unreachable-nodes-from.mprodr"
 	configMapKeyLastChecked      = "lastChecked"
 	configMapKeyUnreachableNodes = "unreachableNodesCSV"
-	configMapKeyCheckedBy        = "checkedByIP"
+	configMapKeyCheckedBy        = "checkedBy"
+	configMapKeyCheckedByIP      = "checkedByIP"
+	configMapKeyProbeResults     = "probeResults"
+	configMapKeyMeshView         = "meshView"
+	configMapKeyTopology         = "topology"
 	configMapLabelName           = "unreachable-nodes"
 	configMapLabelValue          = "true"
 	configMapValidFor            = 60 * time.Second
+
+	// ReportSelector selects all the reports written by ReportProbeResults
+	ReportSelector = configMapLabelName + "=" + configMapLabelValue
 )
 
 // NetNode provides details of which node can't be contacted
 type NetNode struct {
-	IP   string
-	Node *v1.Node
+	// IP is the first internal ip
+	IP string
+	// IPs are all the internal ips (IPv4 and IPv6)
+	IPs []string
+	// Extra are addresses on other networks (e.g. storage)
+	Extra []ExtraTarget
+	Node  *v1.Node
 }
 
 // GetUnreadyNodes returns all the nodes that could be down
@@ -53,9 +66,8 @@ func GetUnreadyNodes(c clientset.Interface) (*v1.NodeList, error) {
 	return &v1.NodeList{Items: unReadyNodes}, nil
 }
 
-// GetNodeInternalIP returns the internal IP address of the node object
-// Maybe we should error if there's more than a single IP unless
-// opted in (as workloads could be commiting remote data)
+// GetNodeInternalIP returns the first internal IP address of the node object
+// - see GetNodeInternalIPs for nodes with several
 func GetNodeInternalIP(node *v1.Node) (string, error) {
 	host := ""
 	for _, address := range node.Status.Addresses {
@@ -72,28 +84,55 @@ func GetNodeInternalIP(node *v1.Node) (string, error) {
 	return host, nil
 }
 
-// ReportUnreachableIPs records the ip addresses that can't be contacted
-// - Used by the detector thread to report all node(s) that are unreachable (from a given source)
-func ReportUnreachableIPs(c clientset.Interface, unreachableNodes []NetNode, reportingNodeIP string, namespace string) error {
+// GetNodeInternalIPs returns all the internal IP addresses of the node object
+// - dual-stack and multi-homed nodes have more than one
+func GetNodeInternalIPs(node *v1.Node) ([]string, error) {
+	var ips []string
+	for _, address := range node.Status.Addresses {
+		if address.Type == v1.NodeInternalIP && address.Address != "" {
+			ips = append(ips, address.Address)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("Couldn't get the internal IP of host %s with addresses %v", node.Name, node.Status.Addresses)
+	}
+	return ips, nil
+}
+
+// ReportProbeResults records the result of probing every target
+// - Used by the detector thread to report all node(s) checked (from a given source)
+// - the unreachable nodes are worked out from the results
+// - mesh and topology are only recorded when set
+func ReportProbeResults(c clientset.Interface, namespace string, r *Report) error {
 	/*
 		Create a unique configmap for the detector with shared label e.g.:
 
 		kind: ConfgMap
 		metadata:
-			name: unreachable-nodes-from.mprodr.x.x.x.x
+			name: unreachable-nodes-from.mprodr.<node name>
 			labels:
-			  source: mpodr-unreachable-results
+			  unreachable-nodes: "true"
 
 		data:
 			lastChecked: datetime
-			unreachableNodes: name,name,name
-			checkedBy: ip
+			unreachableNodesCSV: name,name,name
+			probeResults: [{"node":"name","ip":"ip","reachable":false,"time":"datetime"}]
+			checkedBy: name
+			checkedByIP: ip
+			meshView: [{"node":"name","state":"alive","lastSeen":"datetime"}]
+			topology: {"topology.kubernetes.io/zone":"zone"}
 	*/
 	var unreachableNodeNames []string
-	for _, un := range unreachableNodes {
-		unreachableNodeNames = append(unreachableNodeNames, un.Node.Name)
+	for _, p := range r.Results {
+		if p.IsUnreachable() {
+			unreachableNodeNames = append(unreachableNodeNames, p.Node)
+		}
+	}
+	probeResults, err := json.Marshal(r.Results)
+	if err != nil {
+		return fmt.Errorf("error encoding probe results: %s", err)
 	}
-	cmName := getConfigMapName(reportingNodeIP)
+	cmName := getConfigMapName(r.Reporter)
 	cm := &v1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: namespace,
@@ -103,15 +142,31 @@ func ReportUnreachableIPs(c clientset.Interface, unreachableNodes []NetNode, rep
 			},
 		},
 		Data: map[string]string{
-			configMapKeyLastChecked:      fmt.Sprintf("%s", time.Now().Format(time.RFC3339)),
+			configMapKeyLastChecked:      r.LastChecked.Format(time.RFC3339),
 			configMapKeyUnreachableNodes: strings.Join(unreachableNodeNames, ","),
-			configMapKeyCheckedBy:        reportingNodeIP,
+			configMapKeyProbeResults:     string(probeResults),
+			configMapKeyCheckedBy:        r.Reporter,
+			configMapKeyCheckedByIP:      r.ReporterIP,
 		},
 	}
+	if r.Mesh != nil {
+		meshView, err := json.Marshal(r.Mesh)
+		if err != nil {
+			return fmt.Errorf("error encoding mesh view: %s", err)
+		}
+		cm.Data[configMapKeyMeshView] = string(meshView)
+	}
+	if r.Topology != nil {
+		topology, err := json.Marshal(r.Topology)
+		if err != nil {
+			return fmt.Errorf("error encoding topology: %s", err)
+		}
+		cm.Data[configMapKeyTopology] = string(topology)
+	}
 
 	// Discover if object exists and create / update as appropriate:
 	var create bool
-	_, err := c.CoreV1().ConfigMaps(namespace).Get(cmName, metav1.GetOptions{})
+	_, err = c.CoreV1().ConfigMaps(namespace).Get(cmName, metav1.GetOptions{})
 	if err != nil {
 		if errors.IsNotFound(err) {
 			create = true
@@ -131,66 +186,76 @@ func ReportUnreachableIPs(c clientset.Interface, unreachableNodes []NetNode, rep
 
 // GetUnreachableNodes get nodes that are REPORTED as unreachanble by the function above
 // - used from the monitor thread to provide a consensus of node Unreachability
-func GetUnreachableNodes(c clientset.Interface, namespace string) ([]*v1.Node, error) {
-	/*
-		1. Select configmaps by label
-		2. Verify the reported datetime is within threasholds
-		3. Get a list of Unreachable nodes that have a quorum of results
-	*/
-	var unreachableNodes []*v1.Node
-
-	// get ConfigMaps "reporting node Unreachable"
-	cmOptions := metav1.ListOptions{
-		LabelSelector: configMapLabelName + "=" + configMapLabelValue,
-	}
-	cmList, err := c.CoreV1().ConfigMaps(namespace).List(cmOptions)
+func GetUnreachableNodes(c clientset.Interface, namespace string, policy ConsensusPolicy) ([]*v1.Node, error) {
+	consensus, err := GetConsensus(c, namespace, policy)
 	if err != nil {
-		return nil, fmt.Errorf("error getting configmaps: %s", err)
+		return nil, err
 	}
-	klog.V(4).Infof("got %d configmaps with matching labels", len(cmList.Items))
-
-	allNodes, err := c.CoreV1().Nodes().List(metav1.ListOptions{})
-	if err != nil {
-		// Maybe we should be retrying...?
-		return nil, fmt.Errorf("can't list nodes: %s", err)
+	var unreachableNodes []*v1.Node
+	for _, nc := range consensus {
+		if nc.Unreachable {
+			unreachableNodes = append(unreachableNodes, nc.Node)
+		}
 	}
-	unreadyNodes, err := GetUnreadyNodes(c)
+	return unreachableNodes, nil
+}
+
+// MigrateReports deletes reports that are not keyed by the name of the reporting node
+// - older versions keyed reports by ip so a re-addressed node left a report behind
+// - returns the number of reports deleted
+func MigrateReports(c clientset.Interface, namespace string) (int, error) {
+	cmList, err := c.CoreV1().ConfigMaps(namespace).List(metav1.ListOptions{
+		LabelSelector: ReportSelector,
+	})
 	if err != nil {
-		// Maybe we should be retrying...?
-		return nil, fmt.Errorf("problem getting list of UnReady nodes %s", err)
+		return 0, fmt.Errorf("error getting configmaps: %s", err)
 	}
-	reportingQuorum := len(allNodes.Items) - len(unreadyNodes.Items)
-	klog.V(4).Infof("got results from %d nodes ", reportingQuorum)
-	unReachableReportCountsByHost := make(map[string]int)
+	deleted := 0
 	for _, cm := range cmList.Items {
-		// check the cm checkTime is valid:
-		reportTimeStr := cm.Data[configMapKeyLastChecked]
-		reportTime, err := time.Parse(time.RFC3339, reportTimeStr)
-		if err != nil {
-			klog.Errorf("cannot parse datetime value %s in configmap %s error=%s", reportTimeStr, cm.Name, err)
-			// discount this report
+		nodeName := cm.Data[configMapKeyCheckedBy]
+		if nodeName != "" && cm.Name == getConfigMapName(nodeName) {
 			continue
 		}
-		klog.V(4).Infof("got a report time %s from a node", reportTime)
-		if reportTime.Before(time.Now().Add(configMapValidFor)) {
-			// REAP contender
-			for _, nodeName := range strings.Split((cm.Data[configMapKeyUnreachableNodes]), ",") {
-				unReachableReportCountsByHost[nodeName]++
-			}
+		klog.Infof("deleting report %s not keyed by node name (checked by %q)", cm.Name, cm.Data[configMapKeyCheckedByIP])
+		err := c.CoreV1().ConfigMaps(namespace).Delete(cm.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return deleted, fmt.Errorf("error deleting report %s: %s", cm.Name, err)
 		}
+		deleted++
 	}
-	// Work out if all nodes that have reported agree (above the quorum threashold)
-	for _, node := range unreadyNodes.Items {
-		if _, ok := unReachableReportCountsByHost[node.Name]; ok {
-			klog.V(4).Infof("%d nodes have reported %s as unreachable (quorum is %d)", unReachableReportCountsByHost[node.Name], node.Name, reportingQuorum)
-			if unReachableReportCountsByHost[node.Name] >= reportingQuorum {
-				unreachableNodes = append(unreachableNodes, &node)
-			}
+	return deleted, nil
+}
+
+// DeleteDepartedReports removes reports that should no longer be considered
+// - the reporting node no longer exists
+// - the report has not been updated for longer than retention (zero keeps silent reports)
+// - returns the number of reports deleted
+func DeleteDepartedReports(c clientset.Interface, namespace string, allNodes []v1.Node, reports []*Report, retention time.Duration, now time.Time) (int, error) {
+	nodes := make(map[string]bool)
+	for _, node := range allNodes {
+		nodes[node.Name] = true
+	}
+	deleted := 0
+	for _, r := range reports {
+		var reason string
+		switch {
+		case !nodes[r.Reporter]:
+			reason = fmt.Sprintf("reporter %s no longer exists", r.Reporter)
+		case retention > 0 && now.Sub(r.LastChecked) > retention:
+			reason = fmt.Sprintf("reporter %s silent for %s", r.Reporter, now.Sub(r.LastChecked).Round(time.Second))
+		default:
+			continue
 		}
+		klog.Infof("deleting report %s as %s", r.Name, reason)
+		err := c.CoreV1().ConfigMaps(namespace).Delete(r.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return deleted, fmt.Errorf("error deleting report %s: %s", r.Name, err)
+		}
+		deleted++
 	}
-	return unreachableNodes, nil
+	return deleted, nil
 }
 
-func getConfigMapName(sourceIP string) string {
-	return fmt.Sprintf("%s.%s", nodeConfigMapNamePrefix, sourceIP)
+func getConfigMapName(nodeName string) string {
+	return fmt.Sprintf("%s.%s", nodeConfigMapNamePrefix, nodeName)
 }
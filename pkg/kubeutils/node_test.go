@@ -0,0 +1,125 @@
+package kubeutils
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const reportNamespace = "metal-pod-reaper-reports"
+
+// reportConfigMap is a report as written by this or an older version
+func reportConfigMap(name, checkedBy, checkedByIP string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: reportNamespace,
+			Name:      name,
+			Labels:    map[string]string{configMapLabelName: configMapLabelValue},
+		},
+		Data: map[string]string{
+			configMapKeyCheckedBy:   checkedBy,
+			configMapKeyCheckedByIP: checkedByIP,
+		},
+	}
+}
+
+// configMapNames returns the names of all the configmaps left in the report namespace
+func configMapNames(t *testing.T, client *fake.Clientset) map[string]bool {
+	t.Helper()
+	cms, err := client.CoreV1().ConfigMaps(reportNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, cm := range cms.Items {
+		names[cm.Name] = true
+	}
+	return names
+}
+
+func TestMigrateReports(t *testing.T) {
+	other := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: reportNamespace, Name: nodeConfigMapNamePrefix + ".10.0.0.9"}}
+	client := fake.NewSimpleClientset(
+		reportConfigMap(getConfigMapName("node1"), "node1", "10.0.0.1"),
+		// Keyed by ip by older versions, with and without the reporter name
+		reportConfigMap(nodeConfigMapNamePrefix+".10.0.0.2", "node2", "10.0.0.2"),
+		reportConfigMap(nodeConfigMapNamePrefix+".10.0.0.3", "", "10.0.0.3"),
+		// Not a report
+		other,
+	)
+	deleted, err := MigrateReports(client, reportNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 reports to be deleted, got %d", deleted)
+	}
+	names := configMapNames(t, client)
+	expected := map[string]bool{getConfigMapName("node1"): true, other.Name: true}
+	if len(names) != len(expected) {
+		t.Errorf("expected %v to be left, got %v", expected, names)
+	}
+	for name := range expected {
+		if !names[name] {
+			t.Errorf("expected %s to be kept", name)
+		}
+	}
+
+	// Nothing more to do on the next run
+	if deleted, err := MigrateReports(client, reportNamespace); err != nil || deleted != 0 {
+		t.Errorf("expected nothing to be deleted again, got %d %v", deleted, err)
+	}
+}
+
+func TestDeleteDepartedReports(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		retention time.Duration
+		kept      []string
+	}{
+		{name: "departed and silent", retention: 5 * time.Minute, kept: []string{"node1"}},
+		{name: "no retention keeps silent reporters", kept: []string{"node1", "node2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			lastChecked := map[string]time.Time{
+				"node1": now.Add(-10 * time.Second),
+				"node2": now.Add(-10 * time.Minute),
+				// node9 has left the cluster
+				"node9": now.Add(-10 * time.Second),
+			}
+			for reporter, at := range lastChecked {
+				if err := ReportProbeResults(client, reportNamespace, &Report{Reporter: reporter, LastChecked: at}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			reports, err := GetReports(client, reportNamespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allNodes := []v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}, {ObjectMeta: metav1.ObjectMeta{Name: "node2"}}}
+
+			deleted, err := DeleteDepartedReports(client, reportNamespace, allNodes, reports, test.retention, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != len(lastChecked)-len(test.kept) {
+				t.Errorf("expected %d reports to be deleted, got %d", len(lastChecked)-len(test.kept), deleted)
+			}
+			names := configMapNames(t, client)
+			if len(names) != len(test.kept) {
+				t.Errorf("expected reports from %v to be kept, got %v", test.kept, names)
+			}
+			for _, reporter := range test.kept {
+				if !names[getConfigMapName(reporter)] {
+					t.Errorf("expected the report from %s to be kept", reporter)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package kubeutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	nodeSnapshotNamePrefix   = "node-snapshot.mprodr"
+	nodeSnapshotLabelName    = "node-snapshot"
+	nodeSnapshotLabelValue   = "true"
+	nodeSnapshotKeyNodeName  = "nodeName"
+	nodeSnapshotKeyNodeUID   = "nodeUID"
+	nodeSnapshotKeyDeletedAt = "deletedAt"
+	nodeSnapshotKeyLabels    = "labels"
+	nodeSnapshotKeyTaints    = "taints"
+
+	// NodeSnapshotSelector selects all the snapshots saved by SaveNodeSnapshot
+	NodeSnapshotSelector = nodeSnapshotLabelName + "=" + nodeSnapshotLabelValue
+)
+
+// systemTaintPrefixes are taints managed by kubernetes itself which must not
+// be carried over to a re-registered node
+var systemTaintPrefixes = []string{
+	"node.kubernetes.io/",
+	"node.cloudprovider.kubernetes.io/",
+}
+
+// systemLabelPrefixes are labels the kubelet sets itself when it registers
+// - topology labels are kept as they are set by operators on bare metal
+var systemLabelPrefixes = []string{
+	"kubernetes.io/",
+	"beta.kubernetes.io/",
+	"node.kubernetes.io/",
+}
+
+// GetNodeNotReadySince returns the time a node last transitioned away from Ready
+// - returns false if the node is Ready (or has never reported a Ready condition)
+func GetNodeNotReadySince(node *v1.Node) (time.Time, bool) {
+	for _, c := range node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			if c.Status == v1.ConditionTrue {
+				return time.Time{}, false
+			}
+			return c.LastTransitionTime.Time, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// SaveNodeSnapshot records the operator labels and taints of a node deleted at
+// now so they can be re-applied if a node with the same name re-registers
+// - labels and taints managed by kubernetes are left out (see RestoreNodeSnapshots)
+func SaveNodeSnapshot(c clientset.Interface, node *v1.Node, namespace string, now time.Time) error {
+	operatorLabels := make(map[string]string)
+	for k, v := range node.Labels {
+		if !isSystemLabel(k) {
+			operatorLabels[k] = v
+		}
+	}
+	labels, err := json.Marshal(operatorLabels)
+	if err != nil {
+		return fmt.Errorf("error encoding labels for node %s: %s", node.Name, err)
+	}
+	var operatorTaints []v1.Taint
+	for _, t := range node.Spec.Taints {
+		if !isSystemTaint(t) {
+			operatorTaints = append(operatorTaints, t)
+		}
+	}
+	taints, err := json.Marshal(operatorTaints)
+	if err != nil {
+		return fmt.Errorf("error encoding taints for node %s: %s", node.Name, err)
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      getNodeSnapshotName(node.Name),
+			Labels: map[string]string{
+				nodeSnapshotLabelName: nodeSnapshotLabelValue,
+			},
+		},
+		Data: map[string]string{
+			nodeSnapshotKeyNodeName:  node.Name,
+			nodeSnapshotKeyNodeUID:   string(node.UID),
+			nodeSnapshotKeyDeletedAt: now.Format(time.RFC3339),
+			nodeSnapshotKeyLabels:    string(labels),
+			nodeSnapshotKeyTaints:    string(taints),
+		},
+	}
+	_, err = c.CoreV1().ConfigMaps(namespace).Create(cm)
+	if errors.IsAlreadyExists(err) {
+		_, err = c.CoreV1().ConfigMaps(namespace).Update(cm)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving snapshot of node %s: %s", node.Name, err)
+	}
+	return nil
+}
+
+// RestoreNodeSnapshots re-applies saved operator labels and taints to any node
+// that has re-registered since it was deleted
+// - values set by the new node take precedence over the snapshot
+// - annotations are never restored as most are written by the kubelet and
+// controllers for the old node (e.g. csi.volume.kubernetes.io/nodeid)
+// - labels and taints managed by kubernetes are skipped (including in
+// snapshots saved by older versions)
+// - the snapshot is removed once applied
+func RestoreNodeSnapshots(c clientset.Interface, namespace string, dryRun bool) error {
+	cmList, err := c.CoreV1().ConfigMaps(namespace).List(metav1.ListOptions{
+		LabelSelector: NodeSnapshotSelector,
+	})
+	if err != nil {
+		return fmt.Errorf("error getting node snapshots: %s", err)
+	}
+	for _, cm := range cmList.Items {
+		nodeName := cm.Data[nodeSnapshotKeyNodeName]
+		node, err := c.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				klog.V(4).Infof("node %s has not re-registered yet", nodeName)
+				continue
+			}
+			return fmt.Errorf("error getting node %s: %s", nodeName, err)
+		}
+		if string(node.UID) == cm.Data[nodeSnapshotKeyNodeUID] {
+			klog.V(4).Infof("node %s is still pending deletion", nodeName)
+			continue
+		}
+		klog.Infof("node %s has re-registered, restoring snapshot from %s (dry-run=%t)", nodeName, cm.Name, dryRun)
+		if dryRun {
+			continue
+		}
+		if err := restoreNodeSnapshot(c, &cm); err != nil {
+			return err
+		}
+		if err := c.CoreV1().ConfigMaps(namespace).Delete(cm.Name, &metav1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("error removing node snapshot %s: %s", cm.Name, err)
+		}
+	}
+	return nil
+}
+
+func restoreNodeSnapshot(c clientset.Interface, cm *v1.ConfigMap) error {
+	var labels map[string]string
+	var taints []v1.Taint
+	if err := json.Unmarshal([]byte(cm.Data[nodeSnapshotKeyLabels]), &labels); err != nil {
+		return fmt.Errorf("error decoding labels in %s: %s", cm.Name, err)
+	}
+	if err := json.Unmarshal([]byte(cm.Data[nodeSnapshotKeyTaints]), &taints); err != nil {
+		return fmt.Errorf("error decoding taints in %s: %s", cm.Name, err)
+	}
+	nodeName := cm.Data[nodeSnapshotKeyNodeName]
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := c.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if node.Labels == nil {
+			node.Labels = make(map[string]string)
+		}
+		for k, v := range labels {
+			if isSystemLabel(k) {
+				continue
+			}
+			if _, ok := node.Labels[k]; !ok {
+				node.Labels[k] = v
+			}
+		}
+		for _, t := range taints {
+			if isSystemTaint(t) || hasTaint(node, t) {
+				continue
+			}
+			node.Spec.Taints = append(node.Spec.Taints, t)
+		}
+		_, err = c.CoreV1().Nodes().Update(node)
+		return err
+	})
+}
+
+func isSystemTaint(t v1.Taint) bool {
+	for _, prefix := range systemTaintPrefixes {
+		if strings.HasPrefix(t.Key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSystemLabel(key string) bool {
+	for _, prefix := range systemLabelPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTaint(node *v1.Node, t v1.Taint) bool {
+	for _, existing := range node.Spec.Taints {
+		if existing.Key == t.Key && existing.Effect == t.Effect {
+			return true
+		}
+	}
+	return false
+}
+
+func getNodeSnapshotName(nodeName string) string {
+	return fmt.Sprintf("%s.%s", nodeSnapshotNamePrefix, nodeName)
+}
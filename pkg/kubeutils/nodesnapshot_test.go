@@ -0,0 +1,160 @@
+package kubeutils
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const snapshotNamespace = "kube-system"
+
+func snapshotNode(uid types.UID) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "node3",
+			UID:  uid,
+			Labels: map[string]string{
+				"kubernetes.io/hostname":          "node3",
+				"node-role.kubernetes.io/storage": "",
+				LabelRack:                         "r1",
+			},
+			Annotations: map[string]string{
+				"csi.volume.kubernetes.io/nodeid": `{"csi.example.com":"old"}`,
+				AnnotationFenced:                  "true",
+			},
+		},
+		Spec: v1.NodeSpec{
+			Taints: []v1.Taint{
+				{Key: "dedicated", Value: "db", Effect: v1.TaintEffectNoSchedule},
+				{Key: "node.kubernetes.io/unreachable", Effect: v1.TaintEffectNoExecute},
+			},
+		},
+	}
+}
+
+func TestSaveNodeSnapshot(t *testing.T) {
+	node := snapshotNode("old")
+	client := fake.NewSimpleClientset(node)
+	deletedAt := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := SaveNodeSnapshot(client, node, snapshotNamespace, deletedAt); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := client.CoreV1().ConfigMaps(snapshotNamespace).Get(getNodeSnapshotName("node3"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		nodeSnapshotKeyNodeName:  "node3",
+		nodeSnapshotKeyNodeUID:   "old",
+		nodeSnapshotKeyDeletedAt: "2020-01-01T12:00:00Z",
+		nodeSnapshotKeyLabels:    `{"node-role.kubernetes.io/storage":"","topology.kubernetes.io/rack":"r1"}`,
+		nodeSnapshotKeyTaints:    `[{"key":"dedicated","value":"db","effect":"NoSchedule"}]`,
+	}
+	if len(cm.Data) != len(expected) {
+		t.Errorf("expected %d keys, got %v", len(expected), cm.Data)
+	}
+	for k, v := range expected {
+		if cm.Data[k] != v {
+			t.Errorf("expected %s to be %s, got %s", k, v, cm.Data[k])
+		}
+	}
+}
+
+func TestRestoreNodeSnapshots(t *testing.T) {
+	tests := []struct {
+		name     string
+		uid      types.UID
+		dryRun   bool
+		restored bool
+	}{
+		{name: "re-registered", uid: "new", restored: true},
+		{name: "pending deletion", uid: "old"},
+		{name: "dry-run", uid: "new", dryRun: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			if err := SaveNodeSnapshot(client, snapshotNode("old"), snapshotNamespace, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			// The kubelet registers the node again with its own labels and annotations
+			registered := &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "node3",
+					UID:         test.uid,
+					Labels:      map[string]string{"kubernetes.io/hostname": "node3", LabelRack: "r2"},
+					Annotations: map[string]string{"volumes.kubernetes.io/controller-managed-attach-detach": "true"},
+				},
+			}
+			if _, err := client.CoreV1().Nodes().Create(registered); err != nil {
+				t.Fatal(err)
+			}
+			if err := RestoreNodeSnapshots(client, snapshotNamespace, test.dryRun); err != nil {
+				t.Fatal(err)
+			}
+
+			node, err := client.CoreV1().Nodes().Get("node3", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, hasRole := node.Labels["node-role.kubernetes.io/storage"]
+			if hasRole != test.restored || (len(node.Spec.Taints) == 1) != test.restored {
+				t.Errorf("expected restored=%t, got labels %v taints %v", test.restored, node.Labels, node.Spec.Taints)
+			}
+			if node.Labels[LabelRack] != "r2" {
+				t.Errorf("expected the new node's label to take precedence, got %s", node.Labels[LabelRack])
+			}
+			if len(node.Annotations) != 1 {
+				t.Errorf("expected no annotations to be restored, got %v", node.Annotations)
+			}
+			for _, taint := range node.Spec.Taints {
+				if isSystemTaint(taint) {
+					t.Errorf("expected system taints not to be restored, got %v", taint)
+				}
+			}
+			_, err = client.CoreV1().ConfigMaps(snapshotNamespace).Get(getNodeSnapshotName("node3"), metav1.GetOptions{})
+			if removed := errors.IsNotFound(err); removed != test.restored {
+				t.Errorf("expected the snapshot removed=%t, got %t", test.restored, removed)
+			}
+		})
+	}
+}
+
+func TestRestoreNodeSnapshotsSkipsSystemLabels(t *testing.T) {
+	// Snapshots saved by older versions kept every label and annotation
+	client := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node3", UID: "new"}},
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: snapshotNamespace,
+				Name:      getNodeSnapshotName("node3"),
+				Labels:    map[string]string{nodeSnapshotLabelName: nodeSnapshotLabelValue},
+			},
+			Data: map[string]string{
+				nodeSnapshotKeyNodeName: "node3",
+				nodeSnapshotKeyNodeUID:  "old",
+				nodeSnapshotKeyLabels:   `{"beta.kubernetes.io/arch":"amd64","dedicated":"db"}`,
+				nodeSnapshotKeyTaints:   `[{"key":"node.kubernetes.io/unreachable","effect":"NoExecute"}]`,
+				"annotations":           `{"csi.volume.kubernetes.io/nodeid":"{}"}`,
+			},
+		},
+	)
+	if err := RestoreNodeSnapshots(client, snapshotNamespace, false); err != nil {
+		t.Fatal(err)
+	}
+	node, err := client.CoreV1().Nodes().Get("node3", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Labels) != 1 || node.Labels["dedicated"] != "db" {
+		t.Errorf("expected only the operator label, got %v", node.Labels)
+	}
+	if len(node.Spec.Taints) != 0 || len(node.Annotations) != 0 {
+		t.Errorf("expected no taints or annotations, got %v %v", node.Spec.Taints, node.Annotations)
+	}
+}
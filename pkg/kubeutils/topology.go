@@ -0,0 +1,98 @@
+package kubeutils
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// LabelZone is the well known zone label
+	LabelZone = "topology.kubernetes.io/zone"
+	// LabelZoneBeta is the zone label set by older kubelets and cloud providers
+	LabelZoneBeta = "failure-domain.beta.kubernetes.io/zone"
+	// LabelRack is the rack (top of rack switch) a node is in
+	LabelRack = "topology.kubernetes.io/rack"
+
+	// QuorumAll every Ready node must agree a node is unreachable
+	QuorumAll = "all"
+	// QuorumCrossDomain a majority of Ready nodes must agree, including at
+	// least one reporter in a different failure domain to the node
+	QuorumCrossDomain = "cross-domain"
+)
+
+// DefaultTopologyLabels are the node labels that make up a failure domain
+var DefaultTopologyLabels = []string{LabelZone, LabelZoneBeta, LabelRack}
+
+// ConsensusPolicy controls how reports are combined into a verdict
+type ConsensusPolicy struct {
+	// Quorum is QuorumAll (the default) or QuorumCrossDomain
+	Quorum string
+	// TopologyLabels are the node labels that make up a failure domain
+	// (DefaultTopologyLabels when empty)
+	TopologyLabels []string
+}
+
+// IsValidQuorum is true for a quorum the consensus understands
+func IsValidQuorum(quorum string) bool {
+	return quorum == "" || quorum == QuorumAll || quorum == QuorumCrossDomain
+}
+
+func (p ConsensusPolicy) labels() []string {
+	if len(p.TopologyLabels) == 0 {
+		return DefaultTopologyLabels
+	}
+	return p.TopologyLabels
+}
+
+// required is the number of agreeing reporters needed given the Ready nodes
+func (p ConsensusPolicy) required(ready int) int {
+	if p.Quorum == QuorumCrossDomain {
+		return ready/2 + 1
+	}
+	return ready
+}
+
+// GetNodeTopology returns the topology labels set on a node
+// - returns nil when the node has none of them
+func GetNodeTopology(node *v1.Node, labels []string) map[string]string {
+	var topology map[string]string
+	for _, label := range labels {
+		if value, ok := node.Labels[label]; ok && value != "" {
+			if topology == nil {
+				topology = make(map[string]string)
+			}
+			topology[label] = value
+		}
+	}
+	return topology
+}
+
+// InDifferentDomains is true when two topologies are known to be in different failure domains
+// - only the labels set on both are compared, a label missing from either is
+// not evidence of a different domain
+// - false when no label is set on both (the domains are unknown)
+func InDifferentDomains(a, b map[string]string, labels []string) bool {
+	for _, label := range labels {
+		valueA, okA := a[label]
+		valueB, okB := b[label]
+		if okA && okB && valueA != valueB {
+			return true
+		}
+	}
+	return false
+}
+
+// FailureDomain is the failure domain of a topology as a single string
+// - e.g. "topology.kubernetes.io/zone=a,topology.kubernetes.io/rack=r1"
+// - empty when none of the labels are set (the domain is unknown)
+func FailureDomain(topology map[string]string, labels []string) string {
+	var parts []string
+	for _, label := range labels {
+		if value, ok := topology[label]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", label, value))
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,106 @@
+package kubeutils
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func topologyNode(name string, ready v1.ConditionStatus, labels map[string]string) v1.Node {
+	return v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}},
+		},
+	}
+}
+
+func TestInDifferentDomains(t *testing.T) {
+	labels := []string{LabelZone, LabelRack}
+	tests := []struct {
+		name      string
+		a, b      map[string]string
+		different bool
+	}{
+		{
+			name:      "different rack",
+			a:         map[string]string{LabelZone: "a", LabelRack: "r1"},
+			b:         map[string]string{LabelZone: "a", LabelRack: "r2"},
+			different: true,
+		},
+		{
+			name: "same domain",
+			a:    map[string]string{LabelZone: "a", LabelRack: "r1"},
+			b:    map[string]string{LabelZone: "a", LabelRack: "r1"},
+		},
+		{
+			name: "missing rack in the same zone",
+			a:    map[string]string{LabelZone: "a"},
+			b:    map[string]string{LabelZone: "a", LabelRack: "r1"},
+		},
+		{
+			name:      "missing rack in another zone",
+			a:         map[string]string{LabelZone: "b"},
+			b:         map[string]string{LabelZone: "a", LabelRack: "r1"},
+			different: true,
+		},
+		{
+			name: "no shared labels",
+			a:    map[string]string{LabelZone: "a"},
+			b:    map[string]string{LabelRack: "r1"},
+		},
+		{
+			name: "unknown",
+			b:    map[string]string{LabelZone: "a", LabelRack: "r1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if different := InDifferentDomains(test.a, test.b, labels); different != test.different {
+				t.Errorf("expected different=%t, got %t", test.different, different)
+			}
+		})
+	}
+}
+
+func TestEvaluateConsensusReporterMissingLabel(t *testing.T) {
+	now := time.Now()
+	policy := ConsensusPolicy{Quorum: QuorumCrossDomain, TopologyLabels: []string{LabelZone, LabelRack}}
+	nodes := []v1.Node{
+		topologyNode("node1", v1.ConditionTrue, map[string]string{LabelZone: "a"}),
+		topologyNode("node2", v1.ConditionTrue, map[string]string{LabelZone: "a", LabelRack: "r1"}),
+		topologyNode("node3", v1.ConditionFalse, map[string]string{LabelZone: "a", LabelRack: "r1"}),
+	}
+	accuse := func(reporter string, topology map[string]string) *Report {
+		return &Report{
+			Reporter:    reporter,
+			LastChecked: now,
+			Unreachable: []string{"node3"},
+			Topology:    topology,
+		}
+	}
+
+	// node1 has no rack label so can't be shown to be in a different domain
+	consensus := EvaluateConsensus(nodes, []*Report{
+		accuse("node1", map[string]string{LabelZone: "a"}),
+		accuse("node2", map[string]string{LabelZone: "a", LabelRack: "r1"}),
+	}, policy, now)
+	if len(consensus) != 1 {
+		t.Fatalf("expected consensus for a single node, got %d", len(consensus))
+	}
+	if len(consensus[0].CrossDomain) != 0 || consensus[0].Unreachable {
+		t.Errorf("expected no cross domain quorum, got cross domain %v unreachable=%t", consensus[0].CrossDomain, consensus[0].Unreachable)
+	}
+
+	// An older report without topology uses the labels of the reporter's node
+	nodes[0].Labels[LabelZone] = "b"
+	consensus = EvaluateConsensus(nodes, []*Report{
+		accuse("node1", nil),
+		accuse("node2", map[string]string{LabelZone: "a", LabelRack: "r1"}),
+	}, policy, now)
+	if len(consensus[0].CrossDomain) != 1 || !consensus[0].Unreachable {
+		t.Errorf("expected node1 to be cross domain, got cross domain %v unreachable=%t", consensus[0].CrossDomain, consensus[0].Unreachable)
+	}
+}
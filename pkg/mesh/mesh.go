@@ -0,0 +1,412 @@
+// Package mesh runs a SWIM style UDP heartbeat between detectors so each one
+// knows which peers it can reach without relying on the apiserver
+package mesh
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/klog"
+)
+
+const (
+	// StateAlive the peer answered its last probe (directly or indirectly)
+	StateAlive = "alive"
+	// StateSuspect the peer missed its last probe
+	StateSuspect = "suspect"
+	// StateDead the peer has been suspect for longer than the suspicion timeout
+	StateDead = "dead"
+
+	msgPing    = "ping"
+	msgPingReq = "ping-req"
+	msgAck     = "ack"
+
+	// indirectProbes is how many other peers are asked to probe a peer that missed a ping
+	indirectProbes = 3
+	maxMessageSize = 1024
+)
+
+// Config controls the mesh
+type Config struct {
+	// Port is the UDP port every member listens on
+	Port int
+	// Interval is the protocol period, one peer is probed each period
+	Interval time.Duration
+	// SuspicionTimeout is how long a peer is suspect before it is dead
+	SuspicionTimeout time.Duration
+}
+
+// Peer is this member's view of another member
+type Peer struct {
+	Node     string    `json:"node"`
+	State    string    `json:"state"`
+	LastSeen time.Time `json:"lastSeen,omitempty"`
+}
+
+type message struct {
+	Type string `json:"type"`
+	From string `json:"from"`
+	Seq  uint64 `json:"seq"`
+	// Target and TargetAddr are set for a ping-req
+	Target     string `json:"target,omitempty"`
+	TargetAddr string `json:"targetAddr,omitempty"`
+}
+
+type peer struct {
+	addr         *net.UDPAddr
+	state        string
+	lastSeen     time.Time
+	suspectSince time.Time
+}
+
+// forward is a ping sent for another member that asked with a ping-req
+type forward struct {
+	addr *net.UDPAddr
+	seq  uint64
+	sent time.Time
+}
+
+// Mesh is a single member of the heartbeat mesh
+type Mesh struct {
+	cfg   Config
+	name  string
+	clock clock.Clock
+	conn  *net.UDPConn
+
+	mu       sync.Mutex
+	peers    map[string]*peer
+	order    []string
+	next     int
+	pending  map[uint64]string
+	forwards map[uint64]forward
+}
+
+// New creates a member of the mesh for the named node
+func New(name string, cfg Config) *Mesh {
+	return &Mesh{
+		cfg:      cfg,
+		name:     name,
+		clock:    clock.RealClock{},
+		peers:    make(map[string]*peer),
+		pending:  make(map[uint64]string),
+		forwards: make(map[uint64]forward),
+	}
+}
+
+// Start listens on the ip and runs the protocol in the background
+// - ip must be the address the peers probe (see SetPeers)
+func (m *Mesh) Start(ip string) error {
+	if err := m.Listen(ip); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			m.probeNext()
+		}
+	}()
+	return nil
+}
+
+// Listen answers and forwards probes from peers in the background
+// - without probing any peers (see Start)
+func (m *Mesh) Listen(ip string) error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, strconv.Itoa(m.cfg.Port)))
+	if err != nil {
+		return fmt.Errorf("error resolving mesh address: %s", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for the mesh on %s: %s", addr, err)
+	}
+	m.conn = conn
+	klog.Infof("mesh listening on %s", addr)
+	go m.receive()
+	return nil
+}
+
+// SetPeers replaces the members of the mesh (node name to ip)
+// - the state of existing members is kept
+func (m *Mesh) SetPeers(ips map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, ip := range ips {
+		if name == m.name {
+			continue
+		}
+		addr := &net.UDPAddr{IP: net.ParseIP(ip), Port: m.cfg.Port}
+		if addr.IP == nil {
+			klog.Errorf("mesh ignoring node %s with invalid ip %q", name, ip)
+			continue
+		}
+		if p, ok := m.peers[name]; ok {
+			p.addr = addr
+			continue
+		}
+		m.peers[name] = &peer{addr: addr, state: StateSuspect, suspectSince: m.clock.Now()}
+	}
+	for name := range m.peers {
+		if _, ok := ips[name]; !ok {
+			delete(m.peers, name)
+		}
+	}
+	m.order = m.order[:0]
+	for name := range m.peers {
+		m.order = append(m.order, name)
+	}
+	rand.Shuffle(len(m.order), func(i, j int) {
+		m.order[i], m.order[j] = m.order[j], m.order[i]
+	})
+	m.next = 0
+}
+
+// View returns the current state of every peer
+func (m *Mesh) View() []Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	view := make([]Peer, 0, len(m.peers))
+	for name, p := range m.peers {
+		m.updateState(p, now)
+		view = append(view, Peer{Node: name, State: p.state, LastSeen: p.lastSeen})
+	}
+	return view
+}
+
+// probeNext runs one protocol period against the next peer
+// - a direct ping, then ping-reqs through other peers if there's no ack
+func (m *Mesh) probeNext() {
+	ackTimeout := m.cfg.Interval / 3
+	target, addr, ok := m.nextPeer()
+	if !ok {
+		m.clock.Sleep(m.cfg.Interval)
+		return
+	}
+	sent := m.clock.Now()
+	m.send(addr, message{Type: msgPing, Seq: m.expectAck(target)})
+	m.clock.Sleep(ackTimeout)
+	if m.seenSince(target, sent) {
+		m.clock.Sleep(m.cfg.Interval - ackTimeout)
+		return
+	}
+	for _, helper := range m.randomPeers(target, indirectProbes) {
+		m.send(helper, message{
+			Type:       msgPingReq,
+			Seq:        m.expectAck(target),
+			Target:     target,
+			TargetAddr: addr.String(),
+		})
+	}
+	m.clock.Sleep(m.cfg.Interval - ackTimeout)
+	if !m.seenSince(target, sent) {
+		m.suspect(target)
+	}
+	m.expire(sent)
+}
+
+// expire forgets acks that were never received
+// - only one peer is probed at a time so nothing pending is still expected
+func (m *Mesh) expire(before time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = make(map[uint64]string)
+	for seq, fwd := range m.forwards {
+		if fwd.sent.Before(before) {
+			delete(m.forwards, seq)
+		}
+	}
+}
+
+func (m *Mesh) receive() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			klog.Errorf("mesh error reading: %s", err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		msg := message{}
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			klog.V(4).Infof("mesh ignoring message from %s: %s", from, err)
+			continue
+		}
+		m.handle(msg, from)
+	}
+}
+
+// handle answers a message
+// - pings and ping-reqs are only answered for a known peer sending from its
+// address, and ping-reqs only forwarded to a peer's address, so the mesh can't
+// be used to reflect packets at other hosts
+func (m *Mesh) handle(msg message, from *net.UDPAddr) {
+	// Hearing from a member directly means it is reachable, but only trust
+	// the name when the message came from the member's address
+	trusted := m.seenFrom(msg.From, from)
+	switch msg.Type {
+	case msgPing:
+		if !trusted {
+			return
+		}
+		m.send(from, message{Type: msgAck, Seq: msg.Seq})
+	case msgPingReq:
+		if !trusted {
+			return
+		}
+		addr, ok := m.peerAddr(msg.Target, msg.TargetAddr)
+		if !ok {
+			klog.V(4).Infof("mesh ignoring ping-req from %s for unknown peer %s at %s", msg.From, msg.Target, msg.TargetAddr)
+			return
+		}
+		seq := newSeq()
+		m.mu.Lock()
+		m.forwards[seq] = forward{addr: from, seq: msg.Seq, sent: m.clock.Now()}
+		m.mu.Unlock()
+		m.send(addr, message{Type: msgPing, Seq: seq})
+	case msgAck:
+		m.mu.Lock()
+		fwd, isForward := m.forwards[msg.Seq]
+		delete(m.forwards, msg.Seq)
+		target, isPending := m.pending[msg.Seq]
+		delete(m.pending, msg.Seq)
+		m.mu.Unlock()
+		if isForward {
+			m.send(fwd.addr, message{Type: msgAck, Seq: fwd.seq})
+		}
+		if isPending {
+			m.seen(target)
+		}
+	}
+}
+
+func (m *Mesh) send(addr *net.UDPAddr, msg message) {
+	msg.From = m.name
+	b, err := json.Marshal(msg)
+	if err != nil {
+		klog.Errorf("mesh error encoding message: %s", err)
+		return
+	}
+	if _, err := m.conn.WriteToUDP(b, addr); err != nil {
+		klog.V(4).Infof("mesh error sending %s to %s: %s", msg.Type, addr, err)
+	}
+}
+
+func (m *Mesh) nextPeer() (string, *net.UDPAddr, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.order) == 0 {
+		return "", nil, false
+	}
+	if m.next >= len(m.order) {
+		m.next = 0
+	}
+	name := m.order[m.next]
+	m.next++
+	return name, m.peers[name].addr, true
+}
+
+func (m *Mesh) randomPeers(exclude string, n int) []*net.UDPAddr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var addrs []*net.UDPAddr
+	for _, i := range rand.Perm(len(m.order)) {
+		name := m.order[i]
+		if name == exclude || m.peers[name].state != StateAlive {
+			continue
+		}
+		addrs = append(addrs, m.peers[name].addr)
+		if len(addrs) == n {
+			break
+		}
+	}
+	return addrs
+}
+
+// expectAck records a sequence number for an ack from the target
+// - sequence numbers are random so an ack can't be forged without seeing the ping
+func (m *Mesh) expectAck(target string) uint64 {
+	seq := newSeq()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[seq] = target
+	return seq
+}
+
+func newSeq() uint64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		// Not expected - fall back to the weaker source rather than stop
+		return rand.Uint64()
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// seenFrom marks a peer seen when a message claiming to be from it came from its address
+// - returns false (and marks nothing) for any other sender
+func (m *Mesh) seenFrom(name string, from *net.UDPAddr) bool {
+	m.mu.Lock()
+	p, ok := m.peers[name]
+	trusted := ok && p.addr.IP.Equal(from.IP)
+	m.mu.Unlock()
+	if !trusted {
+		klog.V(4).Infof("mesh ignoring message claiming to be from %s sent by %s", name, from)
+		return false
+	}
+	m.seen(name)
+	return true
+}
+
+// peerAddr returns the address of a peer if it is the address given
+func (m *Mesh) peerAddr(name, addr string) (*net.UDPAddr, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.peers[name]
+	if !ok || p.addr.String() != addr {
+		return nil, false
+	}
+	return p.addr, true
+}
+
+func (m *Mesh) seen(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.peers[name]; ok {
+		p.lastSeen = m.clock.Now()
+		p.state = StateAlive
+	}
+}
+
+func (m *Mesh) seenSince(name string, t time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.peers[name]
+	return ok && !p.lastSeen.Before(t)
+}
+
+func (m *Mesh) suspect(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.peers[name]
+	if !ok || p.state != StateAlive {
+		return
+	}
+	klog.V(2).Infof("mesh peer %s is suspect", name)
+	p.state = StateSuspect
+	p.suspectSince = m.clock.Now()
+}
+
+// updateState moves a peer from suspect to dead once the suspicion timeout passes
+func (m *Mesh) updateState(p *peer, now time.Time) {
+	if p.state == StateSuspect && now.Sub(p.suspectSince) > m.cfg.SuspicionTimeout {
+		p.state = StateDead
+	}
+}
@@ -0,0 +1,171 @@
+package mesh
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+var testPeers = map[string]string{
+	"a": "127.0.0.1",
+	"b": "127.0.0.2",
+	"c": "127.0.0.3",
+}
+
+// freePort finds a UDP port to use on every loopback address
+func freePort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func newTestMesh(t *testing.T, name string, cfg Config) *Mesh {
+	t.Helper()
+	m := New(name, cfg)
+	m.SetPeers(testPeers)
+	if err := m.Listen(testPeers[name]); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.conn.Close() })
+	return m
+}
+
+func peerState(m *Mesh, name string) string {
+	for _, p := range m.View() {
+		if p.Node == name {
+			return p.State
+		}
+	}
+	return ""
+}
+
+func waitSeen(m *Mesh, name string, since time.Time) bool {
+	for i := 0; i < 100; i++ {
+		if m.seenSince(name, since) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSuspectToDead(t *testing.T) {
+	cfg := Config{Port: freePort(t), Interval: 3 * time.Second, SuspicionTimeout: 10 * time.Second}
+	fakeClock := clock.NewFakeClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	m := New("a", cfg)
+	m.clock = fakeClock
+	// Only probe b, which isn't listening
+	m.SetPeers(map[string]string{"a": testPeers["a"], "b": testPeers["b"]})
+	if err := m.Listen(testPeers["a"]); err != nil {
+		t.Fatal(err)
+	}
+	defer m.conn.Close()
+
+	m.seen("b")
+	if state := peerState(m, "b"); state != StateAlive {
+		t.Fatalf("expected b to be %s, got %s", StateAlive, state)
+	}
+	fakeClock.Step(time.Second)
+	m.probeNext()
+	if state := peerState(m, "b"); state != StateSuspect {
+		t.Fatalf("expected b to be %s after a missed probe, got %s", StateSuspect, state)
+	}
+	fakeClock.Step(cfg.SuspicionTimeout)
+	if state := peerState(m, "b"); state != StateSuspect {
+		t.Fatalf("expected b to be %s until the suspicion timeout passes, got %s", StateSuspect, state)
+	}
+	fakeClock.Step(time.Second)
+	if state := peerState(m, "b"); state != StateDead {
+		t.Errorf("expected b to be %s after the suspicion timeout, got %s", StateDead, state)
+	}
+}
+
+func TestPingReqForwarding(t *testing.T) {
+	cfg := Config{Port: freePort(t), Interval: time.Second, SuspicionTimeout: 5 * time.Second}
+	a := newTestMesh(t, "a", cfg)
+	b := newTestMesh(t, "b", cfg)
+	newTestMesh(t, "c", cfg)
+	start := a.clock.Now()
+
+	// a can only hear from c through b
+	a.send(a.peers["b"].addr, message{
+		Type:       msgPingReq,
+		Seq:        a.expectAck("c"),
+		Target:     "c",
+		TargetAddr: a.peers["c"].addr.String(),
+	})
+	if !waitSeen(a, "c", start) {
+		t.Fatal("expected a to see c through b")
+	}
+	if !waitSeen(b, "c", start) {
+		t.Error("expected b to see c when it answered the forwarded ping")
+	}
+}
+
+func TestIgnoresSpoofedMessages(t *testing.T) {
+	cfg := Config{Port: freePort(t), Interval: time.Second, SuspicionTimeout: 5 * time.Second}
+	a := newTestMesh(t, "a", cfg)
+	start := a.clock.Now()
+	spoofer := &net.UDPAddr{IP: net.ParseIP(testPeers["b"]), Port: cfg.Port}
+
+	// A message claiming to be from c sent from b's address
+	a.handle(message{Type: msgPing, From: "c", Seq: 1}, spoofer)
+	// An ack for a sequence number a never sent
+	a.expectAck("c")
+	a.handle(message{Type: msgAck, From: "c", Seq: 1}, spoofer)
+	if a.seenSince("c", start) {
+		t.Error("expected c not to be seen from a spoofed message")
+	}
+
+	a.handle(message{Type: msgPing, From: "b", Seq: 1}, spoofer)
+	if !a.seenSince("b", start) {
+		t.Error("expected b to be seen from its own address")
+	}
+}
+
+func TestIgnoresUntrustedRequests(t *testing.T) {
+	cfg := Config{Port: freePort(t), Interval: time.Second, SuspicionTimeout: 5 * time.Second}
+	a := newTestMesh(t, "a", cfg)
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.4"), Port: cfg.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	strangerAddr := stranger.LocalAddr().(*net.UDPAddr)
+	cAddr := a.peers["c"].addr.String()
+
+	// A ping from an unknown host is not answered
+	a.handle(message{Type: msgPing, From: "b", Seq: 1}, strangerAddr)
+	stranger.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := stranger.ReadFromUDP(make([]byte, maxMessageSize)); err == nil {
+		t.Errorf("expected no answer to an unknown host, got %d bytes", n)
+	}
+
+	tests := []struct {
+		name       string
+		from       *net.UDPAddr
+		target     string
+		targetAddr string
+	}{
+		{name: "unknown host", from: strangerAddr, target: "c", targetAddr: cAddr},
+		{name: "target not a peer", from: a.peers["b"].addr, target: "d", targetAddr: strangerAddr.String()},
+		{name: "target at another address", from: a.peers["b"].addr, target: "c", targetAddr: strangerAddr.String()},
+	}
+	for _, test := range tests {
+		a.handle(message{Type: msgPingReq, From: "b", Seq: 1, Target: test.target, TargetAddr: test.targetAddr}, test.from)
+		if len(a.forwards) != 0 {
+			t.Errorf("%s: expected the ping-req not to be forwarded", test.name)
+		}
+	}
+
+	a.handle(message{Type: msgPingReq, From: "b", Seq: 1, Target: "c", TargetAddr: cAddr}, a.peers["b"].addr)
+	if len(a.forwards) != 1 {
+		t.Error("expected a ping-req from a peer for a peer to be forwarded")
+	}
+}
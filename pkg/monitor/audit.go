@@ -0,0 +1,140 @@
+package monitor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/appvia/metal-pod-reaper/pkg/audit"
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/reaper"
+)
+
+const (
+	// ConsensusUnreachable a quorum agree the node is unreachable
+	ConsensusUnreachable = "unreachable"
+	// ConsensusNotAgreed the node is NotReady but there is no quorum
+	ConsensusNotAgreed = "not-agreed"
+	// ConsensusCleared the node is no longer NotReady (Ready again or deleted)
+	ConsensusCleared = "cleared"
+
+	// ActionSucceeded the action completed (or the dry-run was accepted)
+	ActionSucceeded = "succeeded"
+	// ActionFailed the action failed (see the error)
+	ActionFailed = "failed"
+)
+
+// consensusEvidence is what a change in the consensus for a node was based on
+type consensusEvidence struct {
+	Consensus *kubeutils.NodeConsensus `json:"consensus"`
+	Decision  *Decision                `json:"decision"`
+}
+
+// reapEvidence is the decision to reap a node and what happened to its pods
+type reapEvidence struct {
+	Decision *Decision          `json:"decision"`
+	Pods     []reaper.PodResult `json:"pods,omitempty"`
+}
+
+// SetAudit records every consensus change and action to an audit log
+func (m *Monitor) SetAudit(l *audit.Log) {
+	m.audit = l
+}
+
+// policyVersion identifies the mode and policy so audit entries can be tied to a configuration
+func policyVersion(reap, dryRun bool, policy ReapPolicy) string {
+	b, err := json.Marshal(struct {
+		Reap   bool
+		DryRun bool
+		Policy ReapPolicy
+	}{reap, dryRun, policy})
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// auditConsensus records every node whose consensus has changed since the last pass
+// - a node seen for the first time (e.g. after a fail over) is recorded
+// - a node no longer NotReady is recorded as cleared
+func (m *Monitor) auditConsensus(consensus []kubeutils.NodeConsensus, decisions []*Decision) {
+	if m.lastVerdicts == nil {
+		m.lastVerdicts = make(map[string]string)
+	}
+	seen := make(map[string]bool)
+	for i := range consensus {
+		nc := &consensus[i]
+		seen[nc.NodeName] = true
+		verdict := ConsensusNotAgreed
+		if nc.Unreachable {
+			verdict = ConsensusUnreachable
+		}
+		if m.lastVerdicts[nc.NodeName] == verdict {
+			continue
+		}
+		m.lastVerdicts[nc.NodeName] = verdict
+		evidence := consensusEvidence{Consensus: nc}
+		for _, d := range decisions {
+			if d.Node == nc.NodeName {
+				evidence.Decision = d
+			}
+		}
+		m.record(audit.EventConsensus, nc.NodeName, evidence, verdict, nil)
+	}
+	for node := range m.lastVerdicts {
+		if !seen[node] {
+			delete(m.lastVerdicts, node)
+			m.record(audit.EventConsensus, node, nil, ConsensusCleared, nil)
+		}
+	}
+}
+
+// auditReap records the pods reaped from a node
+// - passes that found nothing to do are not recorded
+// - a dry-run is only recorded when the decision changes (it is repeated every pass)
+func (m *Monitor) auditReap(d *Decision, err error) {
+	evidence := reapEvidence{Decision: d}
+	if d.Result != nil {
+		evidence.Pods = d.Result.Pods
+	}
+	if m.dryRun && !d.changed {
+		return
+	}
+	if err == nil && (d.Result == nil || !d.Result.Changed()) {
+		return
+	}
+	m.record(audit.EventReap, d.Node, evidence, actionOutcome(err), err)
+}
+
+// auditDeleteNode records the deletion of a node
+func (m *Monitor) auditDeleteNode(d *Decision, err error) {
+	if m.dryRun && !d.changed {
+		return
+	}
+	m.record(audit.EventDeleteNode, d.Node, reapEvidence{Decision: d}, actionOutcome(err), err)
+}
+
+func (m *Monitor) record(event, node string, evidence interface{}, outcome string, err error) {
+	e := audit.Entry{
+		Time:          m.clock.Now(),
+		Event:         event,
+		Node:          node,
+		PolicyVersion: m.policyVersion,
+		DryRun:        m.dryRun,
+		Evidence:      evidence,
+		Outcome:       outcome,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	// Errors are logged by the audit log and don't stop the monitor
+	m.audit.Record(e)
+}
+
+func actionOutcome(err error) string {
+	if err != nil {
+		return ActionFailed
+	}
+	return ActionSucceeded
+}
@@ -0,0 +1,267 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/reaper"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// OutcomeNoAction nothing will be done to the node
+	OutcomeNoAction = "no-action"
+	// OutcomeReap the pods on the node will be reaped
+	OutcomeReap = "reap"
+	// OutcomeReapAndDelete the pods will be reaped and the node deleted
+	OutcomeReapAndDelete = "reap-and-delete-node"
+)
+
+// Gate is a single check that a node has to pass before it is reaped
+type Gate struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+// Decision records every gate considered for a node and the final outcome
+type Decision struct {
+	Node       string    `json:"node"`
+	Time       time.Time `json:"time"`
+	DryRun     bool      `json:"dryRun"`
+	Gates      []Gate    `json:"gates"`
+	Reap       bool      `json:"reap"`
+	DeleteNode bool      `json:"deleteNode"`
+	Outcome    string    `json:"outcome"`
+	// NodeDeleted is set once Tick has deleted the node (or would have in dry-run)
+	// - deletion waits while the reap failed or evicted pods remain
+	NodeDeleted bool `json:"nodeDeleted,omitempty"`
+	// Result is set once the pods have been reaped
+	Result *reaper.Result `json:"-"`
+
+	node *v1.Node
+	// changed is set when the outcome differs from the last pass
+	changed bool
+}
+
+// Explain walks through every gate for a node using the same logic as the monitor loop
+// - consensus, reports and leases are as returned from kubeutils for the whole cluster
+func (m *Monitor) Explain(node *v1.Node, consensus []kubeutils.NodeConsensus, reports []*kubeutils.Report, leases map[string]time.Time, now time.Time) *Decision {
+	d := &Decision{
+		Node:    node.Name,
+		Time:    now,
+		DryRun:  m.dryRun,
+		Outcome: OutcomeNoAction,
+		node:    node,
+	}
+
+	since, notReady := kubeutils.GetNodeNotReadySince(node)
+	readyStatus := v1.ConditionUnknown
+	for _, c := range node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			readyStatus = c.Status
+		}
+	}
+	if !notReady {
+		d.gate("not-ready", false, "Ready=%s", readyStatus)
+		return d
+	}
+	d.gate("not-ready", true, "Ready=%s for %s", readyStatus, now.Sub(since).Round(time.Second))
+
+	if renewed, ok := leases[node.Name]; ok {
+		age := now.Sub(renewed)
+		passed := age >= m.policy.MinLeaseAge
+		d.gate("lease", passed, "renewed %s ago, need %s", age.Round(time.Second), m.policy.MinLeaseAge)
+		if !passed {
+			return d
+		}
+	} else {
+		d.gate("lease", true, "no lease for node")
+	}
+
+	var nc *kubeutils.NodeConsensus
+	for i := range consensus {
+		if consensus[i].NodeName == node.Name {
+			nc = &consensus[i]
+		}
+	}
+	if nc == nil {
+		d.gate("consensus", false, "node not considered by consensus")
+		return d
+	}
+
+	for _, r := range reports {
+		age := now.Sub(r.LastChecked).Round(time.Second)
+		switch {
+		case r.IsStale(now):
+			d.gate("report "+r.Reporter, false, "age %s, excluded as stale", age)
+		case r.Vouches(node.Name):
+			d.gate("report "+r.Reporter, false, "age %s, reachable (veto)", age)
+		case r.Accuses(node.Name):
+			d.gate("report "+r.Reporter, true, "age %s, unreachable", age)
+		case r.IsPending(node.Name):
+			d.gate("report "+r.Reporter, false, "age %s, not confirmed either way (pending)", age)
+		default:
+			d.gate("report "+r.Reporter, false, "age %s, not checked", age)
+		}
+	}
+
+	if m.policy.Consensus.Quorum == kubeutils.QuorumCrossDomain {
+		domain := nc.Domain
+		if domain == "" {
+			domain = "unknown"
+		}
+		d.gate("quorum", nc.Unreachable, "%d agreeing (%d from another failure domain than %s), %d disagreeing (veto), %d unchecked, %d stale, need %d (majority of ready nodes) and 1 from another failure domain",
+			len(nc.Agreeing), len(nc.CrossDomain), domain, len(nc.Disagreeing), len(nc.Unchecked), len(nc.Stale), nc.Quorum)
+	} else {
+		d.gate("quorum", nc.Unreachable, "%d agreeing, %d disagreeing (veto), %d unchecked, %d stale, need %d (ready nodes)",
+			len(nc.Agreeing), len(nc.Disagreeing), len(nc.Unchecked), len(nc.Stale), nc.Quorum)
+	}
+	if !nc.Unreachable {
+		return d
+	}
+
+	if !d.circuitBreakerGate(consensus, m.policy.MaxUnreachableNodes) {
+		return d
+	}
+
+	if m.policy.RequireStorageUnreachable && !d.storageGate(node, reports, now) {
+		return d
+	}
+
+	d.gate("reap-enabled", m.reap, "reap=%t dry-run=%t", m.reap, m.dryRun)
+	if !m.reap {
+		return d
+	}
+	d.Reap = true
+	d.Outcome = OutcomeReap
+
+	fenced := kubeutils.IsNodeFenced(node)
+	d.gate("fenced", fenced, "%s=%q", kubeutils.AnnotationFenced, node.Annotations[kubeutils.AnnotationFenced])
+	if m.policy.DeleteNodeAfter == 0 {
+		d.gate("delete-node", false, "node deletion disabled")
+		return d
+	}
+	notReadyFor := now.Sub(since)
+	deleteNode := fenced && notReadyFor >= m.policy.DeleteNodeAfter
+	d.gate("delete-node", deleteNode, "fenced=%t NotReady for %s, delete after %s",
+		fenced, notReadyFor.Round(time.Second), m.policy.DeleteNodeAfter)
+	if deleteNode {
+		d.DeleteNode = true
+		d.Outcome = OutcomeReapAndDelete
+	}
+	return d
+}
+
+// circuitBreakerGate checks not too many nodes are agreed unreachable at once
+// - when more are, it is more likely the network has failed than the nodes
+func (d *Decision) circuitBreakerGate(consensus []kubeutils.NodeConsensus, maxUnreachable int) bool {
+	var unreachable int
+	for _, nc := range consensus {
+		if nc.Unreachable {
+			unreachable++
+		}
+	}
+	if maxUnreachable == 0 {
+		d.gate("circuit-breaker", true, "%d nodes agreed unreachable, circuit breaker disabled", unreachable)
+		return true
+	}
+	passed := unreachable <= maxUnreachable
+	state := "closed"
+	if !passed {
+		state = "open"
+	}
+	d.gate("circuit-breaker", passed, "%s, %d nodes agreed unreachable, at most %d", state, unreachable, maxUnreachable)
+	return passed
+}
+
+// storageGate checks the storage network of a node is also unreachable
+// - a single reporter that can reach the storage address fails the gate
+func (d *Decision) storageGate(node *v1.Node, reports []*kubeutils.Report, now time.Time) bool {
+	storageIP := node.Annotations[kubeutils.AnnotationStorageIP]
+	if storageIP == "" {
+		d.gate("storage-unreachable", true, "no %s annotation", kubeutils.AnnotationStorageIP)
+		return true
+	}
+	var reachable, unreachable []string
+	for _, r := range reports {
+		if r.IsStale(now) {
+			continue
+		}
+		result, ok := r.NetworkResult(node.Name, kubeutils.NetworkStorage)
+		switch {
+		case !ok || result.Error != "":
+			continue
+		case result.Reachable:
+			reachable = append(reachable, r.Reporter)
+		default:
+			unreachable = append(unreachable, r.Reporter)
+		}
+	}
+	passed := len(reachable) == 0 && len(unreachable) > 0
+	d.gate("storage-unreachable", passed, "%s unreachable from %d, reachable from %d %v",
+		storageIP, len(unreachable), len(reachable), reachable)
+	return passed
+}
+
+// String is the decision encoded as a single line of json for logging
+func (d *Decision) String() string {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Sprintf("error encoding decision for %s: %s", d.Node, err)
+	}
+	return string(b)
+}
+
+func (d *Decision) gate(name string, passed bool, format string, args ...interface{}) {
+	d.Gates = append(d.Gates, Gate{
+		Name:   name,
+		Passed: passed,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// decide gets the current reports and works out what to do with every NotReady node
+func (m *Monitor) decide(client clientset.Interface) ([]*Decision, error) {
+	reports, err := kubeutils.GetReports(client, m.reports())
+	if err != nil {
+		return nil, err
+	}
+	allNodes, err := client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("can't list nodes: %s", err)
+	}
+	leases, err := kubeutils.GetNodeLeases(client)
+	if err != nil {
+		return nil, err
+	}
+	now := m.clock.Now()
+	consensus := kubeutils.EvaluateConsensus(allNodes.Items, reports, m.policy.Consensus, now)
+	var decisions []*Decision
+	for _, nc := range consensus {
+		d := m.Explain(nc.Node, consensus, reports, leases, now)
+		m.logDecision(d)
+		decisions = append(decisions, d)
+	}
+	m.auditConsensus(consensus, decisions)
+	return decisions, nil
+}
+
+// logDecision logs the full trace whenever the outcome for a node changes
+func (m *Monitor) logDecision(d *Decision) {
+	if m.lastOutcomes == nil {
+		m.lastOutcomes = make(map[string]string)
+	}
+	if m.lastOutcomes[d.Node] == d.Outcome {
+		klog.V(4).Infof("decision: %s", d)
+		return
+	}
+	m.lastOutcomes[d.Node] = d.Outcome
+	d.changed = true
+	klog.Infof("decision: %s", d)
+}
@@ -0,0 +1,89 @@
+package monitor
+
+import (
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+const (
+	heartbeatName    = "metal-pod-reaper-monitor-heartbeat"
+	heartbeatKeyTime = "lastWrite"
+	heartbeatKeyBy   = "writtenBy"
+
+	// DefaultMaxAPIServerLatency is the default bound on the heartbeat round trip
+	DefaultMaxAPIServerLatency = 5 * time.Second
+)
+
+// checkFreshness makes sure our view of the apiserver is current before deciding
+// - a heartbeat is written and read back (proving writes work and reads are not stale)
+// - the round trip must complete within the policy's MaxAPIServerLatency
+// - a monitor that has not yet completed a heartbeat (e.g. a new leader) has no
+// proven view so decides nothing until one succeeds
+// - lists made after this are quorum reads so are at least as fresh as the heartbeat
+func (m *Monitor) checkFreshness(client clientset.Interface) error {
+	start := m.clock.Now()
+	previous := m.lastHeartbeat
+	// Not proven fresh again until this heartbeat succeeds
+	m.lastHeartbeat = time.Time{}
+	if err := m.writeHeartbeat(client, start); err != nil {
+		return fmt.Errorf("apiserver heartbeat failed (last success %s): %s", formatSince(previous, start), err)
+	}
+	maxLatency := m.policy.MaxAPIServerLatency
+	if maxLatency <= 0 {
+		maxLatency = DefaultMaxAPIServerLatency
+	}
+	if latency := m.clock.Since(start); latency > maxLatency {
+		return fmt.Errorf("apiserver heartbeat took %s (more than %s), the view may be stale", latency.Round(time.Millisecond), maxLatency)
+	}
+	m.lastHeartbeat = start
+	return nil
+}
+
+// writeHeartbeat records the time in a configmap and reads it back
+func (m *Monitor) writeHeartbeat(client clientset.Interface, now time.Time) error {
+	value := now.Format(time.RFC3339Nano)
+	cms := client.CoreV1().ConfigMaps(m.namespace)
+	cm, err := cms.Get(heartbeatName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm, err = cms.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      heartbeatName,
+				Namespace: m.namespace,
+			},
+			Data: map[string]string{
+				heartbeatKeyTime: value,
+				heartbeatKeyBy:   m.nodeName,
+			},
+		})
+	} else if err == nil {
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[heartbeatKeyTime] = value
+		cm.Data[heartbeatKeyBy] = m.nodeName
+		cm, err = cms.Update(cm)
+	}
+	if err != nil {
+		return err
+	}
+	readBack, err := cms.Get(heartbeatName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if readBack.Data[heartbeatKeyTime] != value {
+		return fmt.Errorf("read back %q after writing %q", readBack.Data[heartbeatKeyTime], value)
+	}
+	return nil
+}
+
+func formatSince(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return now.Sub(t).Round(time.Second).String() + " ago"
+}
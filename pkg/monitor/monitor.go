@@ -6,12 +6,16 @@ package monitor
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"time"
 
+	"github.com/appvia/metal-pod-reaper/pkg/audit"
 	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
 	"github.com/appvia/metal-pod-reaper/pkg/reaper"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -28,27 +32,95 @@ const (
 	pausePollingSecs = 5 * time.Second
 )
 
+// ReapPolicy controls what happens to nodes once a quorum agrees they are unreachable
+type ReapPolicy struct {
+	// DeleteNodeAfter is how long a fenced node must have been NotReady
+	// before the Node object is deleted (zero disables node deletion)
+	DeleteNodeAfter time.Duration
+	// Pods controls how pods are removed from the node
+	Pods reaper.Policy
+	// MinLeaseAge is how long ago the node Lease must have been renewed
+	// before the node is reaped (zero disables)
+	MinLeaseAge time.Duration
+	// RequireStorageUnreachable only reaps nodes with an annotated storage
+	// network once that network is also agreed to be unreachable
+	RequireStorageUnreachable bool
+	// ReportRetention is how long a report that is no longer updated is kept
+	// (zero only removes reports from nodes that no longer exist)
+	ReportRetention time.Duration
+	// Consensus controls how reports are combined into a verdict
+	Consensus kubeutils.ConsensusPolicy
+	// MaxUnreachableNodes is the most nodes that can be agreed unreachable at
+	// once before nothing is reaped (a circuit breaker against a wide network
+	// failure being mistaken for dead nodes, zero disables)
+	MaxUnreachableNodes int
+	// MaxAPIServerLatency is the longest the apiserver heartbeat (a write and
+	// read back) may take before the view is treated as stale
+	// (DefaultMaxAPIServerLatency when zero)
+	MaxAPIServerLatency time.Duration
+}
+
 // Monitor data for Monitor methods
 type Monitor struct {
 	c         chan error
 	dryRun    bool
 	namespace string
-	hostIP    string
+	nodeName  string
 	reap      bool
+	policy    ReapPolicy
+	recorder  record.EventRecorder
+	clock     clock.Clock
+
+	// reportNamespace holds the detector reports (namespace when empty)
+	reportNamespace string
+
+	lastOutcomes map[string]string
+	// lastVerdicts is the consensus for each node last recorded in the audit log
+	lastVerdicts  map[string]string
+	audit         *audit.Log
+	policyVersion string
+	// lastHeartbeat is when the apiserver last accepted and returned a heartbeat
+	lastHeartbeat time.Time
+	// status is the latest pass for the status endpoint
+	status status
 }
 
 // New creates a default monitor / reaper
-func New(reap, dryRun bool, namespace, hostIP string) *Monitor {
+// - nodeName is the leader election identity
+func New(reap, dryRun bool, namespace, nodeName string, policy ReapPolicy) *Monitor {
 	m := &Monitor{
 		c:         make(chan error),
 		dryRun:    dryRun,
-		hostIP:    hostIP,
+		nodeName:  nodeName,
 		namespace: namespace,
 		reap:      reap,
+		policy:    policy,
+		clock:     clock.RealClock{},
+
+		policyVersion: policyVersion(reap, dryRun, policy),
 	}
 	return m
 }
 
+// SetClock replaces the clock used for all decisions (e.g. for simulation)
+func (m *Monitor) SetClock(clk clock.Clock) {
+	m.clock = clk
+}
+
+// SetReportNamespace reads and collects the detector reports from another namespace
+// - so detectors need no access to the namespace holding the leader lock and plans
+func (m *Monitor) SetReportNamespace(namespace string) {
+	m.reportNamespace = namespace
+}
+
+// reports is the namespace holding the detector reports
+func (m *Monitor) reports() string {
+	if m.reportNamespace == "" {
+		return m.namespace
+	}
+	return m.reportNamespace
+}
+
 // RunAsync starts the monitor thread
 // - uses a channel for error handling
 func (m *Monitor) RunAsync() chan error {
@@ -79,32 +151,158 @@ func (m *Monitor) runMonitorLoop() error {
 		return err
 	}
 	klog.Info("started master")
-	var deadNodes []*v1.Node
+	// Remove any reports written by older versions
+	if _, err := kubeutils.MigrateReports(client, m.reports()); err != nil {
+		klog.Errorf("error migrating reports: %s", err)
+	}
 	for {
 		// Don't thrash here..
 		klog.V(4).Info("little pause before work")
 		time.Sleep(pausePollingSecs)
 
-		// Get all the nodes - that have been reported as UnReachable...
-		// reporting happens using configmaps in specified namespace
-		deadNodes, err = kubeutils.GetUnreachableNodes(client, m.namespace)
-		if err != nil {
-			klog.Errorf("error getting nodes reported as unreachable: %s", err)
+		if _, err := m.Tick(client); err != nil {
+			klog.Errorf("error in monitor pass: %s", err)
 			// Try again
 			continue
 		}
-		klog.V(3).Infof("got an unreachable node list (%d nodes)", len(deadNodes))
-
-		// reap any nodes as required...
-		if m.reap && len(deadNodes) > 0 {
-			klog.V(4).Info("We are set to reap")
-			for _, node := range deadNodes {
-				if err := reaper.Reap(node, client, m.dryRun); err != nil {
-					klog.Errorf("error reaping %s, %s", node.Name, err)
-				}
+	}
+}
+
+// Tick runs a single pass of the monitor loop
+// - returns the decision for every NotReady node along with any reap results
+// - no decisions are made while our view of the apiserver may be stale
+func (m *Monitor) Tick(client clientset.Interface) ([]*Decision, error) {
+	if err := m.checkFreshness(client); err != nil {
+		return nil, fmt.Errorf("refusing to decide while degraded: %s", err)
+	}
+	// Decide what to do with all the NotReady nodes based on what has been
+	// reported as UnReachable (using configmaps in specified namespace)
+	decisions, err := m.decide(client)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(3).Infof("got decisions for %d unready nodes", len(decisions))
+
+	// reap any nodes as required...
+	for _, d := range decisions {
+		var reapErr error
+		if d.Reap {
+			d.Result, reapErr = m.reapNode(client, d.node)
+			m.auditReap(d, reapErr)
+		}
+		if d.DeleteNode && reapErr != nil {
+			klog.Errorf("not deleting node %s as the reap failed", d.Node)
+			continue
+		}
+		if d.DeleteNode && d.Result != nil && d.Result.Pending() {
+			klog.V(2).Infof("not deleting node %s until its evicted pods are removed", d.Node)
+			continue
+		}
+		if d.DeleteNode {
+			err := m.deleteNode(client, d.node)
+			if err != nil {
+				klog.Errorf("error deleting node %s, %s", d.Node, err)
 			}
+			d.NodeDeleted = err == nil
+			m.auditDeleteNode(d, err)
+		}
+	}
+
+	// record what a dry-run would do for review before enforcing
+	plans := m.planReaps(client, decisions)
+	if m.dryRun {
+		if err := m.writePlans(client, plans); err != nil {
+			klog.Errorf("error writing plans: %s", err)
+		}
+	}
+	m.setStatus(decisions, plans, m.clock.Now())
+
+	// remove reports from nodes that have gone away or stopped reporting
+	if err := m.collectReports(client); err != nil {
+		klog.Errorf("error removing old reports: %s", err)
+	}
+
+	// re-apply anything saved from deleted nodes that have now come back
+	if m.policy.DeleteNodeAfter > 0 {
+		if err := kubeutils.RestoreNodeSnapshots(client, m.namespace, m.dryRun); err != nil {
+			klog.Errorf("error restoring node snapshots: %s", err)
+		}
+	}
+	return decisions, nil
+}
+
+// collectReports deletes the reports from departed or silent reporters
+func (m *Monitor) collectReports(client clientset.Interface) error {
+	reports, err := kubeutils.GetReports(client, m.reports())
+	if err != nil {
+		return err
+	}
+	allNodes, err := client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("can't list nodes: %s", err)
+	}
+	_, err = kubeutils.DeleteDepartedReports(client, m.reports(), allNodes.Items, reports, m.policy.ReportRetention, m.clock.Now())
+	return err
+}
+
+// reapNode removes the pods from a node and reports on the outcome
+// - the error is set if the pods could not be listed or any could not be removed
+func (m *Monitor) reapNode(client clientset.Interface, node *v1.Node) (*reaper.Result, error) {
+	result, err := reaper.Reap(node, client, m.dryRun, m.policy.Pods, m.clock.Now())
+	if err != nil {
+		klog.Errorf("error reaping %s, %s", node.Name, err)
+		m.event(node, v1.EventTypeWarning, "ReapFailed", "error reaping node: %s", err)
+		return nil, err
+	}
+	if result.Changed() {
+		klog.Infof("reaped node %s: %s", node.Name, result)
+	}
+	if err := result.Err(); err != nil {
+		klog.Errorf("error reaping pods from %s: %s", node.Name, err)
+		m.event(node, v1.EventTypeWarning, "ReapFailed", "reaped node %s: %s", result, err)
+		return result, err
+	}
+	if result.Changed() {
+		m.event(node, v1.EventTypeNormal, "Reaped", "reaped node %s", result)
+	}
+	if result.Pending() {
+		return result, nil
+	}
+	// Record the node has been cleared (once per NotReady period)
+	if _, ok := kubeutils.GetNodeReapedAt(node); !ok && !m.dryRun {
+		if err := kubeutils.AnnotateNode(client, node.Name, kubeutils.AnnotationReapedAt, m.clock.Now().Format(time.RFC3339)); err != nil {
+			klog.Error(err)
+		}
+	}
+	return result, nil
+}
+
+// event records an event against a node (when running with an event recorder)
+func (m *Monitor) event(node *v1.Node, eventType, reason, messageFmt string, args ...interface{}) {
+	if m.recorder != nil {
+		m.recorder.Eventf(node, eventType, reason, messageFmt, args...)
+	}
+}
+
+// deleteNode will remove the Node object (once Explain has checked the policy allows)
+// - a snapshot of its operator labels and taints is saved first so they can be
+// restored if it re-registers
+func (m *Monitor) deleteNode(client clientset.Interface, node *v1.Node) error {
+	klog.Infof("deleting fenced node %s (dry-run=%t)", node.Name, m.dryRun)
+	var dryRunValue []string
+	if m.dryRun {
+		dryRunValue = []string{"All"}
+	} else {
+		if err := kubeutils.SaveNodeSnapshot(client, node, m.namespace, m.clock.Now()); err != nil {
+			return err
 		}
 	}
+	// Only delete the node that was decided on, not one that has re-registered
+	// with the same name since
+	return client.CoreV1().Nodes().Delete(node.Name, &metav1.DeleteOptions{
+		DryRun:        dryRunValue,
+		Preconditions: &metav1.Preconditions{UID: &node.UID},
+	})
 }
 
 // RunLeadderElect blocking - should never return (unless unrecoverable error)
@@ -133,9 +331,10 @@ func (m *Monitor) runLeaderElect() error {
 	eventBroadcaster.StartLogging(klog.Infof)
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: leaseLockName})
+	m.recorder = recorder
 
 	rlConfig := resourcelock.ResourceLockConfig{
-		Identity:      m.hostIP,
+		Identity:      m.nodeName,
 		EventRecorder: recorder,
 	}
 	lock, err := resourcelock.New(
@@ -166,6 +365,7 @@ func (m *Monitor) runLeaderElect() error {
 			},
 			OnNewLeader: func(identity string) {
 				klog.V(3).Infof("Current leader: %s", identity)
+				m.setLeader(identity)
 			},
 		},
 	}
@@ -0,0 +1,489 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/reaper"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+const testNamespace = "kube-system"
+
+var testStart = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testNode(name, ip string, ready v1.ConditionStatus) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{
+				Type:               v1.NodeReady,
+				Status:             ready,
+				LastTransitionTime: metav1.NewTime(testStart.Add(-5 * time.Minute)),
+			}},
+		},
+	}
+}
+
+// newTestClient is a cluster where node3 is NotReady with a stateful pod and
+// every other node reports it unreachable
+func newTestClient(t *testing.T) *fake.Clientset {
+	t.Helper()
+	client := fake.NewSimpleClientset(
+		testNode("node1", "10.0.0.1", v1.ConditionTrue),
+		testNode("node2", "10.0.0.2", v1.ConditionTrue),
+		testNode("node3", "10.0.0.3", v1.ConditionFalse),
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "db-0",
+				Namespace: "default",
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: appsv1.SchemeGroupVersion.String(),
+					Kind:       "StatefulSet",
+					Name:       "db",
+				}},
+			},
+			Spec: v1.PodSpec{NodeName: "node3"},
+		},
+	)
+	for _, reporter := range []string{"node1", "node2"} {
+		err := kubeutils.ReportProbeResults(client, testNamespace, &kubeutils.Report{
+			Reporter:    reporter,
+			LastChecked: testStart,
+			Results: []kubeutils.ProbeResult{
+				{Node: "node3", IP: "10.0.0.3", Reachable: false, Time: testStart},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return client
+}
+
+func newTestMonitor(reap bool) (*Monitor, *clock.FakeClock) {
+	fakeClock := clock.NewFakeClock(testStart)
+	m := New(reap, false, testNamespace, "master1", ReapPolicy{})
+	m.SetClock(fakeClock)
+	return m, fakeClock
+}
+
+func podExists(t *testing.T, client *fake.Clientset) bool {
+	t.Helper()
+	_, err := client.CoreV1().Pods("default").Get("db-0", metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func TestTickReaps(t *testing.T) {
+	client := newTestClient(t)
+	m, _ := newTestMonitor(true)
+	decisions, err := m.Tick(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || decisions[0].Outcome != OutcomeReap {
+		t.Fatalf("expected a single reap decision, got %v", decisions)
+	}
+	if podExists(t, client) {
+		t.Error("expected the pod to be reaped")
+	}
+}
+
+func TestTickRefusesStaleView(t *testing.T) {
+	client := newTestClient(t)
+	m, fakeClock := newTestMonitor(true)
+	// The heartbeat read back is slower than the apiserver latency allows
+	client.PrependReactor("get", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.(clienttesting.GetAction).GetName() == heartbeatName {
+			fakeClock.Step(DefaultMaxAPIServerLatency)
+		}
+		return false, nil, nil
+	})
+	decisions, err := m.Tick(client)
+	if err == nil {
+		t.Fatal("expected an error for a stale view")
+	}
+	if decisions != nil {
+		t.Errorf("expected no decisions, got %v", decisions)
+	}
+	if !m.lastHeartbeat.IsZero() {
+		t.Error("expected no successful heartbeat")
+	}
+	if !podExists(t, client) {
+		t.Error("expected the pod not to be reaped")
+	}
+}
+
+func TestTickFailover(t *testing.T) {
+	client := newTestClient(t)
+	// The old leader has written a heartbeat but never reaped
+	old, _ := newTestMonitor(false)
+	if _, err := old.Tick(client); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new leader can't reach the apiserver at first
+	failing := true
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if failing {
+			return true, nil, fmt.Errorf("connection refused")
+		}
+		return false, nil, nil
+	})
+	m, fakeClock := newTestMonitor(true)
+	fakeClock.Step(20 * time.Second)
+	if _, err := m.Tick(client); err == nil {
+		t.Fatal("expected an error while the apiserver is failing")
+	}
+	if !podExists(t, client) {
+		t.Fatal("expected the pod not to be reaped without a heartbeat")
+	}
+
+	failing = false
+	fakeClock.Step(5 * time.Second)
+	decisions, err := m.Tick(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || !decisions[0].Reap {
+		t.Fatalf("expected the new leader to reap, got %v", decisions)
+	}
+	if podExists(t, client) {
+		t.Error("expected the pod to be reaped by the new leader")
+	}
+}
+
+func TestExplainCircuitBreaker(t *testing.T) {
+	nodes := []*v1.Node{
+		testNode("node1", "10.0.0.1", v1.ConditionFalse),
+		testNode("node2", "10.0.0.2", v1.ConditionFalse),
+	}
+	consensus := []kubeutils.NodeConsensus{
+		{Node: nodes[0], NodeName: "node1", Unreachable: true},
+		{Node: nodes[1], NodeName: "node2", Unreachable: true},
+	}
+	tests := []struct {
+		name           string
+		maxUnreachable int
+		reap           bool
+	}{
+		{name: "disabled", reap: true},
+		{name: "closed", maxUnreachable: 2, reap: true},
+		{name: "open", maxUnreachable: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := New(true, false, testNamespace, "master1", ReapPolicy{MaxUnreachableNodes: test.maxUnreachable})
+			d := m.Explain(nodes[0], consensus, nil, nil, testStart)
+			if d.Reap != test.reap {
+				t.Errorf("expected reap=%t, got %s", test.reap, d)
+			}
+		})
+	}
+}
+
+func TestTickReportNamespace(t *testing.T) {
+	client := newTestClient(t)
+	fakeClock := clock.NewFakeClock(testStart)
+	m := New(true, false, "metal-pod-reaper", "master1", ReapPolicy{})
+	m.SetClock(fakeClock)
+	m.SetReportNamespace(testNamespace)
+	decisions, err := m.Tick(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || !decisions[0].Reap {
+		t.Fatalf("expected the reports to be read from %s, got %v", testNamespace, decisions)
+	}
+	if _, err := client.CoreV1().ConfigMaps("metal-pod-reaper").Get(heartbeatName, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the heartbeat in the monitor namespace: %s", err)
+	}
+}
+
+func TestTickDeletesFencedNode(t *testing.T) {
+	client := newTestClient(t)
+	if err := kubeutils.AnnotateNode(client, "node3", kubeutils.AnnotationFenced, "true"); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := newTestMonitor(true)
+	m.policy.DeleteNodeAfter = time.Minute
+	decisions, err := m.Tick(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || !decisions[0].NodeDeleted {
+		t.Fatalf("expected node3 to be deleted, got %v", decisions)
+	}
+	if _, err := client.CoreV1().Nodes().Get("node3", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("expected node3 to be deleted, got %v", err)
+	}
+	snapshots, err := client.CoreV1().ConfigMaps(testNamespace).List(metav1.ListOptions{LabelSelector: kubeutils.NodeSnapshotSelector})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots.Items) != 1 || snapshots.Items[0].Data["deletedAt"] != testStart.Format(time.RFC3339) {
+		t.Errorf("expected a snapshot of node3 deleted at the monitor's time, got %v", snapshots.Items)
+	}
+}
+
+// podActions counts the actions of a verb (and subresource) on each pod
+func podActions(client *fake.Clientset, verb, subresource string) map[string]int {
+	counts := make(map[string]int)
+	for _, action := range client.Actions() {
+		if !action.Matches(verb, "pods") || action.GetSubresource() != subresource {
+			continue
+		}
+		switch a := action.(type) {
+		case clienttesting.DeleteAction:
+			counts[a.GetName()]++
+		case clienttesting.CreateAction:
+			counts[a.GetObject().(*policyv1beta1.Eviction).Name]++
+		}
+	}
+	return counts
+}
+
+func addStatefulPod(t *testing.T, client *fake.Clientset, name string) {
+	t.Helper()
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: appsv1.SchemeGroupVersion.String(),
+				Kind:       "StatefulSet",
+				Name:       "db",
+			}},
+		},
+		Spec: v1.PodSpec{NodeName: "node3"},
+	}
+	if _, err := client.CoreV1().Pods("default").Create(pod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTickFailoverMidReap(t *testing.T) {
+	client := newTestClient(t)
+	addStatefulPod(t, client, "db-1")
+
+	// The old leader deletes db-0 but loses the apiserver (and the lease) before db-1
+	client.PrependReactor("delete", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.(clienttesting.DeleteAction).GetName() == "db-1" {
+			return true, nil, fmt.Errorf("connection refused")
+		}
+		return false, nil, nil
+	})
+	old, _ := newTestMonitor(true)
+	decisions, err := old.Tick(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || decisions[0].Result.Count(reaper.OutcomeDeleted) != 1 || decisions[0].Result.Err() == nil {
+		t.Fatalf("expected the old leader to delete a single pod and fail, got %v", decisions)
+	}
+	client.ReactionChain = client.ReactionChain[1:]
+	client.ClearActions()
+
+	m, fakeClock := newTestMonitor(true)
+	fakeClock.Step(20 * time.Second)
+	decisions, err = m.Tick(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || decisions[0].Result.Err() != nil {
+		t.Fatalf("expected the new leader to finish the reap, got %v", decisions)
+	}
+	if deletes := podActions(client, "delete", ""); len(deletes) != 1 || deletes["db-1"] != 1 {
+		t.Errorf("expected the new leader to only delete db-1, got %v", deletes)
+	}
+	node, err := client.CoreV1().Nodes().Get("node3", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := kubeutils.GetNodeReapedAt(node); !ok {
+		t.Error("expected node3 to be annotated as reaped once all its pods are gone")
+	}
+}
+
+func TestTickFailoverMidEviction(t *testing.T) {
+	client := newTestClient(t)
+	addStatefulPod(t, client, "db-1")
+	client.PrependReactor("create", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return action.GetSubresource() == "eviction", nil, nil
+	})
+	policy := ReapPolicy{Pods: reaper.Policy{Evict: true, EvictionTimeout: 30 * time.Second}}
+
+	// The old leader evicts both pods then loses the lease
+	old, _ := newTestMonitor(true)
+	old.policy = policy
+	if _, err := old.Tick(client); err != nil {
+		t.Fatal(err)
+	}
+	if evictions := podActions(client, "create", "eviction"); len(evictions) != 2 {
+		t.Fatalf("expected the old leader to evict both pods, got %v", evictions)
+	}
+	// The apiserver marks the evicted pods as terminating
+	for _, name := range []string{"db-0", "db-1"} {
+		pod, err := client.CoreV1().Pods("default").Get(name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		grace := int64(0)
+		deletionTimestamp := metav1.NewTime(testStart)
+		pod.DeletionTimestamp = &deletionTimestamp
+		pod.DeletionGracePeriodSeconds = &grace
+		if _, err := client.CoreV1().Pods("default").Update(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.ClearActions()
+
+	// The new leader waits for the same eviction timeout without evicting again
+	m, fakeClock := newTestMonitor(true)
+	m.policy = policy
+	fakeClock.Step(20 * time.Second)
+	decisions, err := m.Tick(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || !decisions[0].Result.Pending() {
+		t.Fatalf("expected the new leader to wait for the evictions, got %v", decisions)
+	}
+	fakeClock.Step(15 * time.Second)
+	if _, err := m.Tick(client); err != nil {
+		t.Fatal(err)
+	}
+	if evictions := podActions(client, "create", "eviction"); len(evictions) != 0 {
+		t.Errorf("expected the new leader not to evict again, got %v", evictions)
+	}
+	if deletes := podActions(client, "delete", ""); len(deletes) != 2 || deletes["db-0"] != 1 || deletes["db-1"] != 1 {
+		t.Errorf("expected each pod to be force deleted once, got %v", deletes)
+	}
+}
+
+func TestExplainStorageGate(t *testing.T) {
+	node := testNode("node3", "10.0.0.3", v1.ConditionFalse)
+	node.Annotations = map[string]string{kubeutils.AnnotationStorageIP: "10.1.0.3"}
+	consensus := []kubeutils.NodeConsensus{{Node: node, NodeName: "node3", Unreachable: true}}
+	report := func(reporter string, age time.Duration, storage string) *kubeutils.Report {
+		r := &kubeutils.Report{
+			Reporter:    reporter,
+			LastChecked: testStart.Add(-age),
+			Results:     []kubeutils.ProbeResult{{Node: "node3", IP: "10.0.0.3"}},
+		}
+		result := kubeutils.AddressResult{Network: kubeutils.NetworkStorage, IP: "10.1.0.3"}
+		switch storage {
+		case "":
+			return r
+		case "up":
+			result.Reachable = true
+		case "error":
+			result.Error = "no route"
+		}
+		r.Results[0].Networks = []kubeutils.AddressResult{result}
+		return r
+	}
+	tests := []struct {
+		name       string
+		annotation bool
+		reports    []*kubeutils.Report
+		reap       bool
+	}{
+		{name: "no storage annotation", reports: []*kubeutils.Report{report("node1", 0, "up")}, reap: true},
+		{name: "storage unreachable", annotation: true, reports: []*kubeutils.Report{report("node1", 0, "down"), report("node2", 0, "down")}, reap: true},
+		{name: "storage reachable from one", annotation: true, reports: []*kubeutils.Report{report("node1", 0, "down"), report("node2", 0, "up")}},
+		{name: "storage reachable in a stale report", annotation: true, reports: []*kubeutils.Report{report("node1", 0, "down"), report("node2", 5*time.Minute, "up")}, reap: true},
+		{name: "storage not probed", annotation: true, reports: []*kubeutils.Report{report("node1", 0, ""), report("node2", 0, "error")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := node.DeepCopy()
+			if !test.annotation {
+				n.Annotations = nil
+			}
+			m := New(true, false, testNamespace, "master1", ReapPolicy{RequireStorageUnreachable: true})
+			d := m.Explain(n, consensus, test.reports, nil, testStart)
+			if d.Reap != test.reap {
+				t.Errorf("expected reap=%t, got %s", test.reap, d)
+			}
+		})
+	}
+}
+
+func TestWritePlans(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	m, _ := newTestMonitor(false)
+	plan := func(at time.Time, pods ...string) *reaper.Plan {
+		p := &reaper.Plan{Node: "node3", Time: at, Actions: []string{reaper.ActionReapPods}}
+		for _, pod := range pods {
+			p.Pods = append(p.Pods, reaper.PodPlan{Namespace: "default", Name: pod, Action: reaper.PathForceDelete})
+		}
+		return p
+	}
+	saved := func() map[string]string {
+		cm, err := client.CoreV1().ConfigMaps(testNamespace).Get(PlanName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cm.Data
+	}
+	tests := []struct {
+		name    string
+		plans   []*reaper.Plan
+		updated bool
+		time    time.Time
+	}{
+		{name: "created", plans: []*reaper.Plan{plan(testStart, "db-0")}, updated: true, time: testStart},
+		{name: "unchanged but for the time", plans: []*reaper.Plan{plan(testStart.Add(time.Minute), "db-0")}, time: testStart},
+		{name: "changed", plans: []*reaper.Plan{plan(testStart.Add(2*time.Minute), "db-0", "db-1")}, updated: true, time: testStart.Add(2 * time.Minute)},
+		{name: "no longer planned", updated: true},
+		{name: "still nothing planned"},
+	}
+	for _, test := range tests {
+		client.ClearActions()
+		if err := m.writePlans(client, test.plans); err != nil {
+			t.Fatal(err)
+		}
+		var written bool
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "create" || action.GetVerb() == "update" {
+				written = true
+			}
+		}
+		if written != test.updated {
+			t.Errorf("%s: expected updated=%t, got %t", test.name, test.updated, written)
+		}
+		data := saved()
+		if len(data) != len(test.plans) {
+			t.Fatalf("%s: expected %d plans, got %v", test.name, len(test.plans), data)
+		}
+		if len(test.plans) == 0 {
+			continue
+		}
+		var p reaper.Plan
+		if err := json.Unmarshal([]byte(data["node3"]), &p); err != nil {
+			t.Fatal(err)
+		}
+		if !p.Time.Equal(test.time) || len(p.Pods) != len(test.plans[0].Pods) {
+			t.Errorf("%s: expected the plan from %s with %d pods, got %s with %d", test.name, test.time, len(test.plans[0].Pods), p.Time, len(p.Pods))
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/reaper"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// PlanName is the configmap holding the latest dry-run plan for every node (keyed by node name)
+const PlanName = "metal-pod-reaper-plan"
+
+// Status is the latest pass of the monitor as served on the status endpoint
+type Status struct {
+	// Leader is the identity of the current leader (only the leader makes passes)
+	Leader string `json:"leader"`
+	DryRun bool   `json:"dryRun"`
+	// PolicyVersion is the policy version recorded in the audit log
+	PolicyVersion string      `json:"policyVersion"`
+	Time          time.Time   `json:"time,omitempty"`
+	Decisions     []*Decision `json:"decisions"`
+	// Plans are what the dry-run would reap (only set in dry-run mode)
+	Plans []*reaper.Plan `json:"plans"`
+	// AuditDropped is the number of audit entries that could not be posted to the webhook
+	AuditDropped int64 `json:"auditDropped"`
+}
+
+// status is shared between the monitor loop and the status endpoint
+type status struct {
+	mu sync.Mutex
+	Status
+}
+
+// ServeHTTP serves the latest status as json
+func (m *Monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.status.mu.Lock()
+	b, err := json.MarshalIndent(m.status.Status, "", "  ")
+	m.status.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// ServeStatus serves the status endpoint (/status) in the background
+func (m *Monitor) ServeStatus(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/status", m)
+	go func() {
+		klog.Infof("serving status on %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			klog.Errorf("error serving status: %s", err)
+		}
+	}()
+}
+
+func (m *Monitor) setLeader(identity string) {
+	m.status.mu.Lock()
+	defer m.status.mu.Unlock()
+	m.status.Leader = identity
+}
+
+// setStatus records a completed pass
+func (m *Monitor) setStatus(decisions []*Decision, plans []*reaper.Plan, now time.Time) {
+	m.status.mu.Lock()
+	defer m.status.mu.Unlock()
+	m.status.DryRun = m.dryRun
+	m.status.PolicyVersion = m.policyVersion
+	m.status.Time = now
+	m.status.Decisions = decisions
+	m.status.Plans = plans
+	m.status.AuditDropped = m.audit.Dropped()
+}
+
+// planReaps works out the plan for every node reaped with dry-run this pass
+func (m *Monitor) planReaps(client clientset.Interface, decisions []*Decision) []*reaper.Plan {
+	var plans []*reaper.Plan
+	if !m.dryRun {
+		return plans
+	}
+	for _, d := range decisions {
+		if d.Result == nil {
+			continue
+		}
+		plans = append(plans, reaper.NewPlan(d.node, client, d.Result, d.DeleteNode, d.Time))
+	}
+	return plans
+}
+
+// writePlans replaces the plans held in the plan configmap
+// - nodes no longer planned for are removed
+// - the configmap is only updated when a plan has changed (not just its time)
+func (m *Monitor) writePlans(client clientset.Interface, plans []*reaper.Plan) error {
+	cms := client.CoreV1().ConfigMaps(m.namespace)
+	cm, err := cms.Get(PlanName, metav1.GetOptions{})
+	var saved map[string]string
+	if err == nil {
+		saved = cm.Data
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+	data := make(map[string]string)
+	for _, plan := range plans {
+		b, err := json.Marshal(plan)
+		if err != nil {
+			return fmt.Errorf("error encoding plan for %s: %s", plan.Node, err)
+		}
+		data[plan.Node] = string(b)
+		if samePlan(saved[plan.Node], plan, b) {
+			data[plan.Node] = saved[plan.Node]
+		}
+	}
+	if errors.IsNotFound(err) {
+		if len(data) == 0 {
+			return nil
+		}
+		_, err = cms.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      PlanName,
+				Namespace: m.namespace,
+			},
+			Data: data,
+		})
+		return err
+	}
+	unchanged := len(cm.Data) == len(data)
+	for node, plan := range data {
+		if cm.Data[node] != plan {
+			unchanged = false
+		}
+	}
+	if unchanged {
+		return nil
+	}
+	cm.Data = data
+	_, err = cms.Update(cm)
+	return err
+}
+
+// samePlan is true when a saved plan only differs from plan (encoded as b) by time
+func samePlan(saved string, plan *reaper.Plan, b []byte) bool {
+	if saved == "" {
+		return false
+	}
+	var old reaper.Plan
+	if err := json.Unmarshal([]byte(saved), &old); err != nil {
+		return false
+	}
+	old.Time = plan.Time
+	oldb, err := json.Marshal(&old)
+	return err == nil && string(oldb) == string(b)
+}
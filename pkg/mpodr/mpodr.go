@@ -3,29 +3,86 @@ package mpodr
 
 import (
 	"errors"
+	"fmt"
 
+	"github.com/appvia/metal-pod-reaper/pkg/audit"
 	"github.com/appvia/metal-pod-reaper/pkg/detector"
 	"github.com/appvia/metal-pod-reaper/pkg/monitor"
 	"k8s.io/klog"
 )
 
-// Run starts the mpodr (metal pod reaper) threads
-func Run(reap, dryRun bool, namespace, hostIP string) error {
-
-	// Start a background thread for running the Monitor
-	//  this will detect a quorum and invokes the reaper
-	// should NOT return
-	m := monitor.New(reap, dryRun, namespace, hostIP)
-	klog.V(2).Info("starting monitor")
-	mCh := m.RunAsync()
-	klog.V(10).Info("master started - main thread continuing")
-
-	// Start a background to run the detector
-	// should NOT return
-	d := detector.New(dryRun, namespace, hostIP)
-	klog.V(2).Info("starting node down detector")
-	dCh := d.RunAsync()
-	klog.V(10).Info("node down detector started - main thread continuing")
+const (
+	// RoleDetector only probes nodes and writes reports (e.g. as a DaemonSet)
+	RoleDetector = "detector"
+	// RoleMonitor only elects a leader to form a consensus and reap (e.g. as a Deployment)
+	RoleMonitor = "monitor"
+	// RoleAll runs both the detector and the monitor
+	RoleAll = "all"
+)
+
+const (
+	// ModeObserve forms a consensus and logs decisions but never reaps
+	ModeObserve = "observe"
+	// ModeDryRun reaps using server side dry-run so nothing is changed
+	ModeDryRun = "dry-run"
+	// ModeEnforce reaps
+	ModeEnforce = "enforce"
+)
+
+// ParseMode returns if the monitor should reap and if it should use dry-run for a mode
+func ParseMode(mode string) (reap, dryRun bool, err error) {
+	switch mode {
+	case ModeObserve:
+		return false, true, nil
+	case ModeDryRun:
+		return true, true, nil
+	case ModeEnforce:
+		return true, false, nil
+	}
+	return false, true, fmt.Errorf("expecting mode of %s, %s or %s not %q", ModeObserve, ModeDryRun, ModeEnforce, mode)
+}
+
+// IsValidRole is true for a known role
+func IsValidRole(role string) bool {
+	return role == RoleDetector || role == RoleMonitor || role == RoleAll
+}
+
+// Run starts the mpodr (metal pod reaper) threads for a role
+// - nodeName and hostIP identify the node we are running on
+// - reports are written to and read from reportNamespace (namespace when empty)
+// - the monitor status is served on statusAddress (when set)
+// - the monitor records its decisions to auditLog (nil to disable)
+func Run(role string, reap, dryRun bool, namespace, reportNamespace, nodeName, hostIP, statusAddress string, auditLog *audit.Log, policy monitor.ReapPolicy, probePolicy detector.ProbePolicy) error {
+	klog.Infof("starting with role %s", role)
+	if reportNamespace == "" {
+		reportNamespace = namespace
+	}
+
+	// A nil channel is never selected below
+	var mCh, dCh chan error
+	if role == RoleMonitor || role == RoleAll {
+		// Start a background thread for running the Monitor
+		//  this will detect a quorum and invokes the reaper
+		// should NOT return
+		m := monitor.New(reap, dryRun, namespace, nodeName, policy)
+		m.SetAudit(auditLog)
+		m.SetReportNamespace(reportNamespace)
+		if statusAddress != "" {
+			m.ServeStatus(statusAddress)
+		}
+		klog.V(2).Info("starting monitor")
+		mCh = m.RunAsync()
+		klog.V(10).Info("master started - main thread continuing")
+	}
+
+	if role == RoleDetector || role == RoleAll {
+		// Start a background to run the detector
+		// should NOT return
+		d := detector.New(dryRun, reportNamespace, nodeName, hostIP, probePolicy)
+		klog.V(2).Info("starting node down detector")
+		dCh = d.RunAsync()
+		klog.V(10).Info("node down detector started - main thread continuing")
+	}
 
 	c := make(chan error)
 	// Merge any errors into a single channels
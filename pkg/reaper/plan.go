@@ -0,0 +1,144 @@
+package reaper
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// ActionSkip the pod will be left alone (see Reason)
+	ActionSkip = "skip"
+	// ActionWaitForDetach the attachment is left for the attach/detach
+	// controller to remove once the pods using it have gone
+	ActionWaitForDetach = "wait-for-detach"
+	// ActionReapPods the pods on the node will be reaped
+	ActionReapPods = "reap-pods"
+	// ActionDeleteNode the Node object will be deleted once the pods are reaped
+	ActionDeleteNode = "delete-node"
+)
+
+// Plan is everything a reap of a node would touch, as found by a dry-run
+type Plan struct {
+	Node string `json:"node"`
+	// Time is when the plan was first made (kept while the plan is unchanged)
+	Time              time.Time        `json:"time"`
+	Pods              []PodPlan        `json:"pods"`
+	VolumeAttachments []AttachmentPlan `json:"volumeAttachments"`
+	// Actions are what will happen to the node itself
+	Actions []string `json:"actions"`
+}
+
+// PodPlan is what would happen to a single pod
+type PodPlan struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Owner is the controller of the pod e.g. StatefulSet/db (a ReplicaSet is
+	// followed to its Deployment)
+	Owner string `json:"owner,omitempty"`
+	// PVCs are the persistent volume claims the pod mounts
+	PVCs []string `json:"pvcs,omitempty"`
+	// Action is how the pod would be removed e.g. PathEviction or ActionSkip
+	Action string `json:"action"`
+	// Outcome is the result of the dry-run
+	Outcome Outcome `json:"outcome"`
+	Reason  string  `json:"reason,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// AttachmentPlan is a volume attached to the node
+type AttachmentPlan struct {
+	Name             string `json:"name"`
+	PersistentVolume string `json:"persistentVolume,omitempty"`
+	Attacher         string `json:"attacher"`
+	Attached         bool   `json:"attached"`
+	Action           string `json:"action"`
+}
+
+// NewPlan describes the pods and volumes a dry-run reap found on a node
+// - result is the outcome of a dry-run Reap of the node
+// - owners and volume attachments that can't be read are logged and left out
+func NewPlan(node *v1.Node, cl kubernetes.Interface, result *Result, deleteNode bool, now time.Time) *Plan {
+	plan := &Plan{
+		Node: node.Name,
+		Time: now,
+	}
+	outcomes := make(map[string]PodResult)
+	for _, p := range result.Pods {
+		outcomes[p.Namespace+"/"+p.Name] = p
+	}
+	for i := range result.listed {
+		pod := &result.listed[i]
+		pp := PodPlan{
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			Owner:     podOwner(cl, pod),
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil {
+				pp.PVCs = append(pp.PVCs, volume.PersistentVolumeClaim.ClaimName)
+			}
+		}
+		if r, ok := outcomes[pod.Namespace+"/"+pod.Name]; ok {
+			pp.Action = r.Path
+			pp.Outcome = r.Outcome
+			pp.Reason = r.Reason
+			pp.Error = r.Error
+			if r.Outcome == OutcomeSkipped {
+				pp.Action = ActionSkip
+			}
+		} else {
+			pp.Action = ActionSkip
+			pp.Reason = "no dry-run result"
+		}
+		plan.Pods = append(plan.Pods, pp)
+	}
+
+	attachments, err := cl.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("planning without volume attachments for %s: %s", node.Name, err)
+	} else {
+		for _, va := range attachments.Items {
+			if va.Spec.NodeName != node.Name {
+				continue
+			}
+			ap := AttachmentPlan{
+				Name:     va.Name,
+				Attacher: va.Spec.Attacher,
+				Attached: va.Status.Attached,
+				Action:   ActionWaitForDetach,
+			}
+			if va.Spec.Source.PersistentVolumeName != nil {
+				ap.PersistentVolume = *va.Spec.Source.PersistentVolumeName
+			}
+			plan.VolumeAttachments = append(plan.VolumeAttachments, ap)
+		}
+	}
+
+	plan.Actions = append(plan.Actions, ActionReapPods)
+	if deleteNode {
+		plan.Actions = append(plan.Actions, ActionDeleteNode)
+	}
+	return plan
+}
+
+// podOwner returns the controller of a pod as Kind/Name
+// - a ReplicaSet owned by a Deployment is reported as the Deployment
+func podOwner(cl kubernetes.Interface, pod *v1.Pod) string {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return ""
+	}
+	if ref.Kind == "ReplicaSet" {
+		rs, err := cl.AppsV1().ReplicaSets(pod.Namespace).Get(ref.Name, metav1.GetOptions{})
+		if err != nil {
+			klog.V(2).Infof("can't get owner of replicaset %s/%s: %s", pod.Namespace, ref.Name, err)
+		} else if rsRef := metav1.GetControllerOf(rs); rsRef != nil {
+			ref = rsRef
+		}
+	}
+	return ref.Kind + "/" + ref.Name
+}
@@ -0,0 +1,80 @@
+package reaper
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func controllerRef(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: kind, Name: name, Controller: &controller}}
+}
+
+func volumeAttachment(name, node, pv string) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: "csi.example.com",
+			NodeName: node,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pv},
+		},
+		Status: storagev1.VolumeAttachmentStatus{Attached: true},
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	db := testPod("db-0")
+	db.OwnerReferences = controllerRef("StatefulSet", "db")
+	db.Spec.Volumes = []v1.Volume{
+		{Name: "data", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data-db-0"}}},
+		{Name: "config", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{}}},
+	}
+	web := testPod("web-abc12")
+	web.OwnerReferences = controllerRef("ReplicaSet", "web-5d8f")
+	mirror := testPod("etcd-node3")
+	mirror.Annotations = map[string]string{mirrorPodAnnotation: "hash"}
+	client := fake.NewSimpleClientset(
+		db, web, mirror,
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web-5d8f", Namespace: "default", OwnerReferences: controllerRef("Deployment", "web")}},
+		volumeAttachment("csi-1", "node3", "pv-1"),
+		volumeAttachment("csi-2", "node2", "pv-2"),
+	)
+	result, err := Reap(testNode, client, true, Policy{}, testStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan := NewPlan(testNode, client, result, true, testStart)
+	if plan.Node != "node3" || !plan.Time.Equal(testStart) {
+		t.Errorf("expected a plan for node3 at %s, got %s at %s", testStart, plan.Node, plan.Time)
+	}
+	expected := map[string]PodPlan{
+		"db-0":       {Owner: "StatefulSet/db", PVCs: []string{"data-db-0"}, Action: PathForceDelete, Outcome: OutcomeDeleted},
+		"web-abc12":  {Owner: "Deployment/web", Action: PathForceDelete, Outcome: OutcomeDeleted},
+		"etcd-node3": {Action: ActionSkip, Outcome: OutcomeSkipped},
+	}
+	if len(plan.Pods) != len(expected) {
+		t.Fatalf("expected %d pods, got %v", len(expected), plan.Pods)
+	}
+	for _, p := range plan.Pods {
+		e := expected[p.Name]
+		if p.Owner != e.Owner || p.Action != e.Action || p.Outcome != e.Outcome {
+			t.Errorf("expected %s to be %+v, got %+v", p.Name, e, p)
+		}
+		if len(p.PVCs) != len(e.PVCs) || (len(e.PVCs) == 1 && p.PVCs[0] != e.PVCs[0]) {
+			t.Errorf("expected %s to mount %v, got %v", p.Name, e.PVCs, p.PVCs)
+		}
+	}
+	attachment := AttachmentPlan{Name: "csi-1", PersistentVolume: "pv-1", Attacher: "csi.example.com", Attached: true, Action: ActionWaitForDetach}
+	if len(plan.VolumeAttachments) != 1 || plan.VolumeAttachments[0] != attachment {
+		t.Errorf("expected only the attachment on node3 %+v, got %+v", attachment, plan.VolumeAttachments)
+	}
+	if len(plan.Actions) != 2 || plan.Actions[0] != ActionReapPods || plan.Actions[1] != ActionDeleteNode {
+		t.Errorf("expected the pods to be reaped and the node deleted, got %v", plan.Actions)
+	}
+}
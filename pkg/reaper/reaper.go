@@ -3,48 +3,271 @@ package reaper
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
 	v1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog"
 )
 
+const (
+	// PathEviction is recorded for pods removed by the Eviction API
+	PathEviction = "eviction"
+	// PathForceDelete is recorded for pods removed by a zero grace period delete
+	PathForceDelete = "force-delete"
+	// PathEvictionFallback is recorded for pods force deleted once the eviction
+	// timeout has passed (after they were evicted or their eviction was refused)
+	PathEvictionFallback = "eviction-fallback-force-delete"
+
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+)
+
+// Policy controls how pods are removed from an unreachable node
+type Policy struct {
+	// Evict will first try the Eviction API (so PodDisruptionBudgets and audit
+	// logs see an eviction) and only force delete pods that remain
+	// - uses policy/v1beta1 as policy/v1 is not in this version of client-go
+	Evict bool
+	// EvictionTimeout is how long evicted pods are left terminating (or pods
+	// with a refused eviction are retried) before they are force deleted (must be
+	// more than zero when evicting)
+	EvictionTimeout time.Duration
+}
+
 // Reap starts deleteing pods from an UnReady node
 // - Should ONLY delete STS and Deployment Pods
 // - Does NOT need to cordon (as the node is UnReady)
-func Reap(node *v1.Node, cl *kubernetes.Clientset, dryRun bool) error {
+// - Never waits for evictions, evicted pods are force deleted by a later call
+// once they have been terminating for the eviction timeout (see Result.Pending)
+// - A refused eviction (e.g. by a PodDisruptionBudget) is retried by later calls
+// and only force deleted once the eviction timeout has passed since the first refusal
+// - Returns an error only if the pods could not be listed, see Result.Err for pod failures
+func Reap(node *v1.Node, cl kubernetes.Interface, dryRun bool, policy Policy, now time.Time) (*Result, error) {
+	result := &Result{
+		Node:   node.Name,
+		DryRun: dryRun,
+	}
 
 	// Get the pods on this node
-	pods, err := cl.CoreV1().Pods("").List(metav1.ListOptions{
-		FieldSelector: "spec.nodeName=" + node.Name,
+	var pods *v1.PodList
+	err := retryTransient(func() (err error) {
+		pods, err = cl.CoreV1().Pods("").List(metav1.ListOptions{
+			FieldSelector: "spec.nodeName=" + node.Name,
+		})
+		return err
 	})
 	if err != nil {
-		return fmt.Errorf("error reaping: %s", node.Name)
+		return nil, fmt.Errorf("error listing pods to reap from %s: %s", node.Name, err)
 	}
 	klog.V(4).Infof("set to reap %d pods from %s", len(pods.Items), node.Name)
+	result.listed = pods.Items
 
 	var dryRunValue []string
 	if dryRun {
 		dryRunValue = []string{"All"}
 	}
+
+	var candidates []v1.Pod
+	for _, pod := range pods.Items {
+		// The kubelet owns mirror pods (static pods) - deleting them achieves nothing
+		if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+			klog.V(2).Infof("skipping mirror pod %s on %s", pod.Name, node.Name)
+			result.add(PodResult{
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				Outcome:   OutcomeSkipped,
+				Reason:    "mirror pod",
+			})
+			continue
+		}
+		candidates = append(candidates, pod)
+	}
+
+	toForce := candidates
+	if policy.Evict {
+		toForce = nil
+		for _, pod := range candidates {
+			// Already evicted (or deleted) - the kubelet will never confirm so
+			// give the controllers the timeout to act and then force delete
+			if evictedAt, ok := terminatingSince(pod); ok {
+				if now.Sub(evictedAt) >= policy.EvictionTimeout {
+					toForce = append(toForce, pod)
+					continue
+				}
+				klog.V(2).Infof("waiting for evicted pod %s on %s (dry-run=%t)", pod.Name, node.Name, dryRun)
+				result.add(PodResult{
+					Namespace: pod.Namespace,
+					Name:      pod.Name,
+					Outcome:   OutcomeEvicting,
+					Path:      PathEviction,
+					Reason:    fmt.Sprintf("force delete in %s", (policy.EvictionTimeout - now.Sub(evictedAt)).Round(time.Second)),
+				})
+				continue
+			}
+			klog.Infof("evicting %s from %s (dry-run=%t)", pod.Name, node.Name, dryRun)
+			err := retryTransient(func() error {
+				return cl.CoreV1().Pods(pod.Namespace).Evict(&policyv1beta1.Eviction{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: pod.Namespace,
+						Name:      pod.Name,
+					},
+					DeleteOptions: &metav1.DeleteOptions{
+						DryRun: dryRunValue,
+					},
+				})
+			})
+			if errors.IsNotFound(err) {
+				result.add(notFound(pod, PathEviction))
+				continue
+			}
+			if err != nil {
+				// e.g. refused by a PodDisruptionBudget - give it the timeout before forcing
+				refusedAt := evictionRefused(cl, pod, dryRun, now)
+				if now.Sub(refusedAt) >= policy.EvictionTimeout {
+					klog.Warningf("error evicting pod %s from %s, will force delete:%s", pod.Name, node.Name, err)
+					toForce = append(toForce, pod)
+					continue
+				}
+				klog.Warningf("error evicting pod %s from %s, will retry:%s", pod.Name, node.Name, err)
+				result.add(PodResult{
+					Namespace: pod.Namespace,
+					Name:      pod.Name,
+					Outcome:   OutcomeEvicting,
+					Path:      PathEviction,
+					Reason:    fmt.Sprintf("eviction refused, force delete in %s", (policy.EvictionTimeout - now.Sub(refusedAt)).Round(time.Second)),
+					Error:     err.Error(),
+				})
+				continue
+			}
+			klog.Infof("pod %s evicted from %s (dry-run=%t)", pod.Name, node.Name, dryRun)
+			result.add(PodResult{
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				Outcome:   OutcomeEvicted,
+				Path:      PathEviction,
+			})
+		}
+	}
+
 	// Define a 0 grace period (equiv to delete now)
 	var gracePeriod int64
 	// Equiv to force?
 	orphanDependents := true
-	for _, pod := range pods.Items {
+	path := PathForceDelete
+	if policy.Evict {
+		path = PathEvictionFallback
+	}
+	for _, pod := range toForce {
 		// could ignore daemonsets or be specific to STS or deploys with volumes
 		// ...but it's a dead node - why care?
 		klog.Infof("reaping %s from %s (dry-run=%t)", pod.Name, node.Name, dryRun)
-		err := cl.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{
-			DryRun:             dryRunValue,
-			OrphanDependents:   &orphanDependents,
-			GracePeriodSeconds: &gracePeriod,
+		err := retryTransient(func() error {
+			return cl.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{
+				DryRun:             dryRunValue,
+				OrphanDependents:   &orphanDependents,
+				GracePeriodSeconds: &gracePeriod,
+			})
 		})
-		if err != nil {
+		switch {
+		case errors.IsNotFound(err):
+			klog.V(2).Infof("pod %s already gone from %s", pod.Name, node.Name)
+			result.add(notFound(pod, path))
+		case err != nil:
 			klog.Errorf("error reaping pod %s from %s:%s", pod.Name, node.Name, err)
+			result.add(PodResult{
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				Outcome:   OutcomeFailed,
+				Path:      path,
+				Error:     err.Error(),
+				Err:       err,
+			})
+		default:
+			klog.Infof("pod %s deleted from %s via %s (dry-run=%t)", pod.Name, node.Name, path, dryRun)
+			result.add(PodResult{
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				Outcome:   OutcomeDeleted,
+				Path:      path,
+			})
+		}
+	}
+	return result, nil
+}
+
+// terminatingSince returns when a terminating pod was evicted (or deleted)
+func terminatingSince(pod v1.Pod) (time.Time, bool) {
+	if pod.DeletionTimestamp == nil {
+		return time.Time{}, false
+	}
+	since := pod.DeletionTimestamp.Time
+	if pod.DeletionGracePeriodSeconds != nil {
+		since = since.Add(-time.Duration(*pod.DeletionGracePeriodSeconds) * time.Second)
+	}
+	return since, true
+}
+
+// evictionRefused returns when the eviction of a pod was first refused
+// - the first refusal is recorded on the pod (unless in dry-run) as a refused
+// pod is not terminating so has no deletion timestamp to measure from
+func evictionRefused(cl kubernetes.Interface, pod v1.Pod, dryRun bool, now time.Time) time.Time {
+	if refusedAt, err := time.Parse(time.RFC3339, pod.Annotations[kubeutils.AnnotationEvictionRefusedAt]); err == nil {
+		return refusedAt
+	}
+	if dryRun {
+		return now
+	}
+	err := retryTransient(func() error {
+		return kubeutils.AnnotatePod(cl, pod.Namespace, pod.Name, kubeutils.AnnotationEvictionRefusedAt, now.Format(time.RFC3339))
+	})
+	if err != nil {
+		// The next call will try again, so the timeout only starts once it's recorded
+		klog.Errorf("error recording refused eviction of %s: %s", pod.Name, err)
+	}
+	return now
+}
+
+// retryTransient retries fn with a backoff while the apiserver reports a transient error
+func retryTransient(fn func() error) error {
+	var lastErr error
+	err := wait.ExponentialBackoff(retry.DefaultBackoff, func() (bool, error) {
+		lastErr = fn()
+		if lastErr == nil {
+			return true, nil
 		}
-		klog.Infof("pod %s deleted from %s (dry-run=%t)", pod.Name, node.Name, dryRun)
+		if isTransient(lastErr) {
+			klog.V(4).Infof("retrying after transient error: %s", lastErr)
+			return false, nil
+		}
+		return false, lastErr
+	})
+	if err == wait.ErrWaitTimeout {
+		return lastErr
+	}
+	return err
+}
+
+// isTransient is true for errors worth retrying
+// - TooManyRequests is not included as that is how an eviction blocked by a PDB is reported
+func isTransient(err error) bool {
+	return errors.IsServerTimeout(err) ||
+		errors.IsTimeout(err) ||
+		errors.IsInternalError(err) ||
+		errors.IsServiceUnavailable(err) ||
+		errors.IsUnexpectedServerError(err)
+}
+
+func notFound(pod v1.Pod, path string) PodResult {
+	return PodResult{
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		Outcome:   OutcomeNotFound,
+		Path:      path,
 	}
-	return nil
 }
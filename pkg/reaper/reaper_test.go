@@ -0,0 +1,222 @@
+package reaper
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	v1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var (
+	testStart = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	testNode  = &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node3"}}
+)
+
+func testPod(name string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: testNode.Name},
+	}
+}
+
+// evictions answers evictions with refuse (nil to accept) and records them
+func evictions(client *fake.Clientset, refuse error) *[]string {
+	var evicted []string
+	client.PrependReactor("create", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		evicted = append(evicted, action.(clienttesting.CreateAction).GetObject().(*policyv1beta1.Eviction).Name)
+		return true, nil, refuse
+	})
+	return &evicted
+}
+
+// terminate marks a pod as terminating as the apiserver would after an eviction
+func terminate(t *testing.T, client *fake.Clientset, name string, at time.Time) {
+	t.Helper()
+	pod, err := client.CoreV1().Pods("default").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grace := int64(30)
+	deletionTimestamp := metav1.NewTime(at.Add(time.Duration(grace) * time.Second))
+	pod.DeletionTimestamp = &deletionTimestamp
+	pod.DeletionGracePeriodSeconds = &grace
+	if _, err := client.CoreV1().Pods("default").Update(pod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reap(t *testing.T, client *fake.Clientset, policy Policy, now time.Time) *Result {
+	t.Helper()
+	result, err := Reap(testNode, client, false, policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func expectOutcome(t *testing.T, result *Result, outcome Outcome, path string) {
+	t.Helper()
+	if len(result.Pods) != 1 {
+		t.Fatalf("expected a single pod result, got %v", result.Pods)
+	}
+	if p := result.Pods[0]; p.Outcome != outcome || p.Path != path {
+		t.Fatalf("expected %s via %q, got %s via %q (%s)", outcome, path, p.Outcome, p.Path, p.Reason)
+	}
+}
+
+func podExists(t *testing.T, client *fake.Clientset, name string) bool {
+	t.Helper()
+	_, err := client.CoreV1().Pods("default").Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func TestReapEvictionTimeout(t *testing.T) {
+	client := fake.NewSimpleClientset(testPod("db-0"))
+	evicted := evictions(client, nil)
+	policy := Policy{Evict: true, EvictionTimeout: time.Minute}
+
+	result := reap(t, client, policy, testStart)
+	expectOutcome(t, result, OutcomeEvicted, PathEviction)
+	if len(*evicted) != 1 || !result.Pending() || !result.Changed() {
+		t.Fatalf("expected a pending eviction, got %d evictions %s", len(*evicted), result)
+	}
+	terminate(t, client, "db-0", testStart)
+
+	// Left evicting until the timeout, without evicting again
+	result = reap(t, client, policy, testStart.Add(30*time.Second))
+	expectOutcome(t, result, OutcomeEvicting, PathEviction)
+	if len(*evicted) != 1 || !result.Pending() || result.Changed() {
+		t.Fatalf("expected to wait for the eviction, got %d evictions %s", len(*evicted), result)
+	}
+	if !podExists(t, client, "db-0") {
+		t.Fatal("expected the evicted pod to be left terminating")
+	}
+
+	result = reap(t, client, policy, testStart.Add(time.Minute))
+	expectOutcome(t, result, OutcomeDeleted, PathEvictionFallback)
+	if result.Pending() || podExists(t, client, "db-0") {
+		t.Errorf("expected the pod to be force deleted after the timeout, got %s", result)
+	}
+}
+
+func TestReapEvictionRefused(t *testing.T) {
+	client := fake.NewSimpleClientset(testPod("db-0"))
+	evicted := evictions(client, errors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0))
+	policy := Policy{Evict: true, EvictionTimeout: time.Minute}
+
+	result := reap(t, client, policy, testStart)
+	expectOutcome(t, result, OutcomeEvicting, PathEviction)
+	if !result.Pending() || !podExists(t, client, "db-0") {
+		t.Fatalf("expected the refused pod not to be force deleted, got %s", result)
+	}
+	pod, err := client.CoreV1().Pods("default").Get("db-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refusedAt := pod.Annotations[kubeutils.AnnotationEvictionRefusedAt]; refusedAt != testStart.Format(time.RFC3339) {
+		t.Fatalf("expected the first refusal to be recorded, got %q", refusedAt)
+	}
+
+	// Retried until the timeout has passed since the first refusal
+	result = reap(t, client, policy, testStart.Add(59*time.Second))
+	expectOutcome(t, result, OutcomeEvicting, PathEviction)
+	if len(*evicted) != 2 || !podExists(t, client, "db-0") {
+		t.Fatalf("expected the eviction to be retried, got %d evictions %s", len(*evicted), result)
+	}
+
+	result = reap(t, client, policy, testStart.Add(time.Minute))
+	expectOutcome(t, result, OutcomeDeleted, PathEvictionFallback)
+	if podExists(t, client, "db-0") {
+		t.Error("expected the refused pod to be force deleted after the timeout")
+	}
+}
+
+// deletes answers pod deletes with each error in turn (then the default) and counts them
+func deletes(client *fake.Clientset, errs ...error) *int {
+	var count int
+	client.PrependReactor("delete", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		count++
+		if count <= len(errs) {
+			return true, nil, errs[count-1]
+		}
+		return false, nil, nil
+	})
+	return &count
+}
+
+func TestReapResults(t *testing.T) {
+	transient := errors.NewServiceUnavailable("etcd leader changed")
+	forbidden := errors.NewForbidden(v1.Resource("pods"), "db-0", fmt.Errorf("not allowed"))
+	mirror := testPod("db-0")
+	mirror.Annotations = map[string]string{mirrorPodAnnotation: "hash"}
+	tests := []struct {
+		name    string
+		pod     *v1.Pod
+		errs    []error
+		outcome Outcome
+		deletes int
+		failed  bool
+	}{
+		{name: "deleted", pod: testPod("db-0"), outcome: OutcomeDeleted, deletes: 1},
+		{name: "already gone", pod: testPod("db-0"), errs: []error{errors.NewNotFound(v1.Resource("pods"), "db-0")}, outcome: OutcomeNotFound, deletes: 1},
+		{name: "transient error then deleted", pod: testPod("db-0"), errs: []error{transient, transient}, outcome: OutcomeDeleted, deletes: 3},
+		{name: "transient error every retry", pod: testPod("db-0"), errs: []error{transient, transient, transient, transient, transient}, outcome: OutcomeFailed, deletes: 4, failed: true},
+		{name: "permanent error not retried", pod: testPod("db-0"), errs: []error{forbidden}, outcome: OutcomeFailed, deletes: 1, failed: true},
+		{name: "mirror pod skipped", pod: mirror, outcome: OutcomeSkipped},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(test.pod)
+			count := deletes(client, test.errs...)
+			result := reap(t, client, Policy{}, testStart)
+			if len(result.Pods) != 1 || result.Pods[0].Outcome != test.outcome {
+				t.Fatalf("expected %s, got %v", test.outcome, result.Pods)
+			}
+			if *count != test.deletes {
+				t.Errorf("expected %d deletes, got %d", test.deletes, *count)
+			}
+			p := result.Pods[0]
+			if failed := result.Err() != nil; failed != test.failed {
+				t.Errorf("expected failed=%t, got %v", test.failed, result.Err())
+			}
+			if test.failed && (p.Error == "" || p.Error != p.Err.Error()) {
+				t.Errorf("expected the error text to be recorded, got %q", p.Error)
+			}
+			if changed := test.outcome == OutcomeDeleted || test.failed; result.Changed() != changed {
+				t.Errorf("expected changed=%t, got %s", changed, result)
+			}
+			if result.Pending() {
+				t.Errorf("expected nothing pending without evictions, got %s", result)
+			}
+		})
+	}
+}
+
+func TestPodResultErrorJSON(t *testing.T) {
+	b, err := json.Marshal(PodResult{Name: "db-0", Outcome: OutcomeFailed, Error: "forbidden", Err: fmt.Errorf("forbidden")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"error":"forbidden"`) {
+		t.Errorf("expected the error in the json, got %s", b)
+	}
+}
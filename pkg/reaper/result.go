@@ -0,0 +1,101 @@
+package reaper
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// Outcome describes what happened to a single pod
+type Outcome string
+
+const (
+	// OutcomeDeleted the pod was removed (or would have been in dry-run)
+	OutcomeDeleted Outcome = "deleted"
+	// OutcomeSkipped the pod was deliberately left alone (see Reason)
+	OutcomeSkipped Outcome = "skipped"
+	// OutcomeFailed the pod could not be removed (see Err)
+	OutcomeFailed Outcome = "failed"
+	// OutcomeNotFound the pod had already gone by the time we got to it
+	OutcomeNotFound Outcome = "not-found"
+	// OutcomeEvicted the pod was evicted and will be force deleted once the
+	// eviction timeout has passed
+	OutcomeEvicted Outcome = "evicted"
+	// OutcomeEvicting the pod was evicted earlier (or its eviction was refused and
+	// will be retried) and is waiting for the eviction timeout
+	OutcomeEvicting Outcome = "evicting"
+)
+
+// PodResult records what happened to a single pod
+type PodResult struct {
+	Namespace string  `json:"namespace"`
+	Name      string  `json:"name"`
+	Outcome   Outcome `json:"outcome"`
+	// Path is how the pod was removed e.g. PathEviction
+	Path string `json:"path,omitempty"`
+	// Reason is why a pod was skipped
+	Reason string `json:"reason,omitempty"`
+	// Error is the text of Err (or of a refused eviction) for reports and audit logs
+	Error string `json:"error,omitempty"`
+	Err   error  `json:"-"`
+}
+
+// Result records what happened to all the pods on a node
+type Result struct {
+	Node   string
+	DryRun bool
+	Pods   []PodResult
+
+	// listed are the pods found on the node (used to plan a dry-run)
+	listed []v1.Pod
+}
+
+// Count returns the number of pods with a given outcome
+func (r *Result) Count(outcome Outcome) int {
+	count := 0
+	for _, p := range r.Pods {
+		if p.Outcome == outcome {
+			count++
+		}
+	}
+	return count
+}
+
+// Pending is true while evicted pods are still waiting to be force deleted
+func (r *Result) Pending() bool {
+	return r.Count(OutcomeEvicted)+r.Count(OutcomeEvicting) > 0
+}
+
+// Changed is true if anything was done (or attempted) this time
+// - pods only waiting for their eviction timeout or skipped don't count
+func (r *Result) Changed() bool {
+	return r.Count(OutcomeDeleted)+r.Count(OutcomeEvicted)+r.Count(OutcomeFailed) > 0
+}
+
+// Err returns all the pod failures as a single error (or nil)
+func (r *Result) Err() error {
+	var errs []error
+	for _, p := range r.Pods {
+		if p.Outcome == OutcomeFailed {
+			errs = append(errs, fmt.Errorf("%s/%s: %s", p.Namespace, p.Name, p.Err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// String provides a one line summary suitable for logs and events
+func (r *Result) String() string {
+	return fmt.Sprintf("deleted=%d evicted=%d evicting=%d skipped=%d failed=%d not-found=%d (dry-run=%t)",
+		r.Count(OutcomeDeleted),
+		r.Count(OutcomeEvicted),
+		r.Count(OutcomeEvicting),
+		r.Count(OutcomeSkipped),
+		r.Count(OutcomeFailed),
+		r.Count(OutcomeNotFound),
+		r.DryRun)
+}
+
+func (r *Result) add(p PodResult) {
+	r.Pods = append(r.Pods, p)
+}
@@ -0,0 +1,366 @@
+// Package simulator replays a snapshot and a timeline of probe outcomes through
+// the detector, consensus and reap logic using a fake clientset and clock
+package simulator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/audit"
+	"github.com/appvia/metal-pod-reaper/pkg/detector"
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/monitor"
+	"github.com/appvia/metal-pod-reaper/pkg/reaper"
+	"github.com/appvia/metal-pod-reaper/pkg/snapshot"
+	v1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var (
+	podsResource = v1.SchemeGroupVersion.WithResource("pods")
+	podsKind     = v1.SchemeGroupVersion.WithKind("Pod")
+)
+
+// Config controls a simulation run
+type Config struct {
+	// Namespace the reports are written to
+	Namespace string
+	// Interval between detector and monitor passes (must be more than zero)
+	Interval time.Duration
+	// Duration of the whole simulation
+	Duration time.Duration
+	// Policy the monitor reaps with
+	Policy monitor.ReapPolicy
+	// Probe policy the detectors use
+	Probe detector.ProbePolicy
+	// Audit is where the monitor records its decisions (nil to disable)
+	Audit *audit.Log
+}
+
+// Event is something that happened during the simulation
+type Event struct {
+	// At is the offset from the start of the simulation
+	At      metav1.Duration    `json:"at"`
+	Node    string             `json:"node"`
+	Message string             `json:"message"`
+	Pods    []reaper.PodResult `json:"pods,omitempty"`
+}
+
+// simulation holds the state of a single run
+type simulation struct {
+	cfg        Config
+	client     *fake.Clientset
+	clock      *clock.FakeClock
+	start      time.Time
+	nodeIPs    map[string]string
+	targets    map[string]string
+	down       map[string]bool
+	partitions map[string]map[string]bool
+	monitor    *monitor.Monitor
+	detectors  map[string]*detector.Detector
+	outcomes   map[string]string
+	events     []Event
+}
+
+// Run replays the timeline against the snapshot and returns what happened
+// - evicted pods are left terminating (there are no controllers or kubelets) so
+// they are force deleted once the eviction timeout has passed
+// - pods are really removed from the fake cluster so dry-run is not simulated
+func Run(snap *snapshot.Snapshot, timeline *Timeline, cfg Config) ([]Event, error) {
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("expecting an interval of more than zero not %s", cfg.Interval)
+	}
+	var objects []runtime.Object
+	for i := range snap.Nodes {
+		objects = append(objects, &snap.Nodes[i])
+	}
+	for i := range snap.Pods {
+		objects = append(objects, &snap.Pods[i])
+	}
+	for i := range snap.Leases {
+		objects = append(objects, &snap.Leases[i])
+	}
+	for i := range snap.Reports {
+		report := snap.Reports[i].DeepCopy()
+		report.Namespace = cfg.Namespace
+		objects = append(objects, report)
+	}
+	fakeClock := clock.NewFakeClock(snap.CapturedAt)
+	client, err := newClient(objects, fakeClock)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &simulation{
+		cfg:        cfg,
+		client:     client,
+		clock:      fakeClock,
+		start:      snap.CapturedAt,
+		nodeIPs:    make(map[string]string),
+		targets:    make(map[string]string),
+		down:       make(map[string]bool),
+		partitions: make(map[string]map[string]bool),
+		outcomes:   make(map[string]string),
+		detectors:  make(map[string]*detector.Detector),
+	}
+	for i := range snap.Nodes {
+		node := &snap.Nodes[i]
+		if ips, err := kubeutils.GetNodeInternalIPs(node); err == nil {
+			s.nodeIPs[node.Name] = ips[0]
+			for _, ip := range ips {
+				s.targets[ip] = node.Name
+			}
+		}
+		// Other networks go down along with the node
+		for _, extra := range kubeutils.GetNodeExtraTargets(node) {
+			s.targets[extra.IP] = node.Name
+		}
+	}
+	s.monitor = monitor.New(true, false, cfg.Namespace, "simulator", cfg.Policy)
+	s.monitor.SetClock(s.clock)
+	s.monitor.SetAudit(cfg.Audit)
+
+	next := 0
+	for elapsed := time.Duration(0); elapsed <= cfg.Duration; elapsed += cfg.Interval {
+		s.clock.SetTime(s.start.Add(elapsed))
+		for next < len(timeline.Steps) && timeline.Steps[next].At.Duration <= elapsed {
+			if err := s.apply(timeline.Steps[next]); err != nil {
+				return s.events, err
+			}
+			next++
+		}
+		if err := s.detect(); err != nil {
+			return s.events, err
+		}
+		if err := s.reap(); err != nil {
+			return s.events, err
+		}
+	}
+	return s.events, nil
+}
+
+// apply makes the changes in a step to the simulated cluster
+func (s *simulation) apply(step Step) error {
+	for _, name := range step.NotReady {
+		if err := s.setReady(name, v1.ConditionUnknown); err != nil {
+			return err
+		}
+		s.record(name, "node NotReady", nil)
+	}
+	for _, name := range step.Ready {
+		if err := s.setReady(name, v1.ConditionTrue); err != nil {
+			return err
+		}
+		s.record(name, "node Ready", nil)
+	}
+	for _, name := range step.Down {
+		s.down[name] = true
+		s.record(name, "node stops answering probes", nil)
+	}
+	for _, name := range step.Up {
+		delete(s.down, name)
+		s.record(name, "node answers probes", nil)
+	}
+	for reporter, targets := range step.Partitions {
+		s.partitions[reporter] = make(map[string]bool)
+		for _, target := range targets {
+			s.partitions[reporter][target] = true
+		}
+		s.record(reporter, fmt.Sprintf("reporter partitioned from %v", targets), nil)
+	}
+	return nil
+}
+
+// detect runs a detector pass from every Ready node
+// - Ready nodes renew their Lease first as a kubelet would
+func (s *simulation) detect() error {
+	nodes, err := s.client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range nodes.Items {
+		reporter := &nodes.Items[i]
+		if !kubeutils.IsNodeReady(reporter) {
+			continue
+		}
+		if err := s.renewLease(reporter.Name); err != nil {
+			return err
+		}
+		ip, ok := s.nodeIPs[reporter.Name]
+		if !ok {
+			continue
+		}
+		// Detectors are kept between passes for their probe history
+		d, ok := s.detectors[reporter.Name]
+		if !ok {
+			probe := s.cfg.Probe
+			probe.MinLeaseAge = s.cfg.Policy.MinLeaseAge
+			probe.TopologyLabels = s.cfg.Policy.Consensus.TopologyLabels
+			d = detector.NewForClient(s.client, s.probeFrom(reporter.Name), s.clock, s.cfg.Namespace, reporter.Name, ip, probe)
+			s.detectors[reporter.Name] = d
+		}
+		if _, err := d.Check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reap runs a monitor pass and records any change of decision or reaped pods
+func (s *simulation) reap() error {
+	decisions, err := s.monitor.Tick(s.client)
+	if err != nil {
+		return err
+	}
+	for _, d := range decisions {
+		if s.outcomes[d.Node] != d.Outcome {
+			s.outcomes[d.Node] = d.Outcome
+			s.record(d.Node, "decision "+d.Outcome, nil)
+		}
+		if d.Result != nil && d.Result.Changed() {
+			s.record(d.Node, "reaped "+d.Result.String(), d.Result.Pods)
+		}
+		if d.NodeDeleted {
+			s.record(d.Node, "node deleted", nil)
+		}
+	}
+	return nil
+}
+
+// probeFrom returns a probe for a reporter using the current timeline state
+func (s *simulation) probeFrom(reporter string) detector.ProbeFunc {
+	return func(ip string) (bool, error) {
+		name, ok := s.targets[ip]
+		if !ok {
+			return false, fmt.Errorf("no node with ip %s in snapshot", ip)
+		}
+		return s.down[name] || s.partitions[reporter][name], nil
+	}
+}
+
+// renewLease updates the node Lease (if the snapshot has one)
+func (s *simulation) renewLease(name string) error {
+	leases := s.client.CoordinationV1beta1().Leases(kubeutils.NodeLeaseNamespace)
+	lease, err := leases.Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	renewTime := metav1.NewMicroTime(s.clock.Now())
+	lease.Spec.RenewTime = &renewTime
+	_, err = leases.Update(lease)
+	return err
+}
+
+func (s *simulation) setReady(name string, status v1.ConditionStatus) error {
+	node, err := s.client.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting node %s from snapshot: %s", name, err)
+	}
+	condition := v1.NodeCondition{
+		Type:               v1.NodeReady,
+		Status:             status,
+		LastTransitionTime: metav1.NewTime(s.clock.Now()),
+	}
+	var found bool
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == v1.NodeReady {
+			node.Status.Conditions[i] = condition
+			found = true
+		}
+	}
+	if !found {
+		node.Status.Conditions = append(node.Status.Conditions, condition)
+	}
+	_, err = s.client.CoreV1().Nodes().Update(node)
+	return err
+}
+
+func (s *simulation) record(node, message string, pods []reaper.PodResult) {
+	s.events = append(s.events, Event{
+		At:      metav1.Duration{Duration: s.clock.Since(s.start)},
+		Node:    node,
+		Message: message,
+		Pods:    pods,
+	})
+}
+
+// newClient creates a fake clientset that (unlike the default) honours the
+// pod field selectors the reaper relies on and implements eviction
+// - an evicted pod is marked terminating at the time on the clock
+func newClient(objects []runtime.Object, clk clock.Clock) (*fake.Clientset, error) {
+	tracker := clienttesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, obj := range objects {
+		if err := tracker.Add(obj); err != nil {
+			return nil, fmt.Errorf("error loading snapshot object: %s", err)
+		}
+	}
+	client := fake.NewSimpleClientset()
+	client.ReactionChain = nil
+	client.AddReactor("list", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		restrictions := action.(clienttesting.ListAction).GetListRestrictions()
+		obj, err := tracker.List(podsResource, podsKind, action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		return true, filterPods(obj.(*v1.PodList), restrictions.Labels, restrictions.Fields), nil
+	})
+	client.AddReactor("create", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(clienttesting.CreateAction).GetObject().(*policyv1beta1.Eviction)
+		if eviction.DeleteOptions != nil && len(eviction.DeleteOptions.DryRun) > 0 {
+			_, err := tracker.Get(podsResource, eviction.Namespace, eviction.Name)
+			return true, nil, err
+		}
+		obj, err := tracker.Get(podsResource, eviction.Namespace, eviction.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		pod := obj.(*v1.Pod).DeepCopy()
+		if pod.DeletionTimestamp != nil {
+			return true, nil, nil
+		}
+		grace := int64(v1.DefaultTerminationGracePeriodSeconds)
+		if pod.Spec.TerminationGracePeriodSeconds != nil {
+			grace = *pod.Spec.TerminationGracePeriodSeconds
+		}
+		deletionTimestamp := metav1.NewTime(clk.Now().Add(time.Duration(grace) * time.Second))
+		pod.DeletionTimestamp = &deletionTimestamp
+		pod.DeletionGracePeriodSeconds = &grace
+		return true, nil, tracker.Update(podsResource, pod, eviction.Namespace)
+	})
+	client.AddReactor("*", "*", clienttesting.ObjectReaction(tracker))
+	return client, nil
+}
+
+func filterPods(pods *v1.PodList, labelSelector labels.Selector, fieldSelector fields.Selector) *v1.PodList {
+	filtered := &v1.PodList{}
+	for _, pod := range pods.Items {
+		podFields := fields.Set{
+			"metadata.name":      pod.Name,
+			"metadata.namespace": pod.Namespace,
+			"spec.nodeName":      pod.Spec.NodeName,
+		}
+		if labelSelector != nil && !labelSelector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		if fieldSelector != nil && !fieldSelector.Matches(podFields) {
+			continue
+		}
+		filtered.Items = append(filtered.Items, pod)
+	}
+	return filtered
+}
@@ -0,0 +1,111 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/detector"
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	"github.com/appvia/metal-pod-reaper/pkg/reaper"
+	"github.com/appvia/metal-pod-reaper/pkg/snapshot"
+)
+
+// runExample replays docs/examples with the same defaults as the simulate command
+func runExample(t *testing.T, configure func(*Config)) []Event {
+	t.Helper()
+	snap, err := snapshot.Load("../../docs/examples/snapshot.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeline, err := LoadTimeline("../../docs/examples/timeline.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		Namespace: "kube-system",
+		Interval:  5 * time.Second,
+		Duration:  timeline.Steps[len(timeline.Steps)-1].At.Duration + 5*time.Minute,
+		Probe: detector.ProbePolicy{
+			UnreachableAfter: 3,
+			ReachableAfter:   2,
+			AddressPolicy:    detector.AddressPolicyAllFail,
+		},
+	}
+	cfg.Policy.MinLeaseAge = 40 * time.Second
+	cfg.Policy.Pods.EvictionTimeout = time.Minute
+	cfg.Policy.Consensus = kubeutils.ConsensusPolicy{Quorum: kubeutils.QuorumAll, TopologyLabels: kubeutils.DefaultTopologyLabels}
+	if configure != nil {
+		configure(&cfg)
+	}
+	events, err := Run(snap, timeline, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+// findEvents returns the events for a node with a message
+func findEvents(events []Event, node, message string) []Event {
+	var found []Event
+	for _, e := range events {
+		if e.Node == node && e.Message == message {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func TestRunExample(t *testing.T) {
+	events := runExample(t, nil)
+
+	// The documented outcome: node3 loses power at 30s and is reaped at 1m15s
+	reaped := findEvents(events, "node3", "decision reap")
+	if len(reaped) != 1 || reaped[0].At.Duration != time.Minute+15*time.Second {
+		t.Fatalf("expected node3 to be reaped once at 1m15s, got %v", reaped)
+	}
+	if noAction := findEvents(events, "node3", "decision no-action"); len(noAction) == 0 || noAction[0].At.Duration != 30*time.Second {
+		t.Errorf("expected no action while node3 renews its lease at 30s, got %v", noAction)
+	}
+	var pods []reaper.PodResult
+	for _, e := range events {
+		if e.Node != "node3" && e.Node != "" {
+			t.Errorf("expected only node3 to change, got %s at %s: %s", e.Node, e.At.Duration, e.Message)
+		}
+		if len(e.Pods) > 0 && e.At.Duration != reaped[0].At.Duration {
+			t.Errorf("expected pods to be reaped only at %s, got %s", reaped[0].At.Duration, e.At.Duration)
+		}
+		pods = append(pods, e.Pods...)
+	}
+	if len(pods) != 1 || pods[0].Name != "db-0" || pods[0].Outcome != reaper.OutcomeDeleted || pods[0].Path != reaper.PathForceDelete {
+		t.Errorf("expected db-0 to be force deleted, got %v", pods)
+	}
+	if deleted := findEvents(events, "node3", "node deleted"); len(deleted) != 0 {
+		t.Errorf("expected node3 not to be deleted by default, got %v", deleted)
+	}
+}
+
+func TestRunDeletesNodeOnceReaped(t *testing.T) {
+	events := runExample(t, func(cfg *Config) {
+		cfg.Policy.Pods.Evict = true
+		cfg.Policy.DeleteNodeAfter = time.Second
+	})
+
+	var forcedAt time.Duration
+	for _, e := range events {
+		for _, p := range e.Pods {
+			if p.Outcome == reaper.OutcomeDeleted && p.Path == reaper.PathEvictionFallback {
+				forcedAt = e.At.Duration
+			}
+		}
+	}
+	if forcedAt != 2*time.Minute+15*time.Second {
+		t.Fatalf("expected the evicted pod to be force deleted at 2m15s, got %s", forcedAt)
+	}
+	deleted := findEvents(events, "node3", "node deleted")
+	if len(deleted) != 1 {
+		t.Fatalf("expected node3 to be deleted once, got %d times", len(deleted))
+	}
+	if deleted[0].At.Duration < forcedAt {
+		t.Errorf("expected node3 to be deleted after its pods at %s, got %s", forcedAt, deleted[0].At.Duration)
+	}
+}
@@ -0,0 +1,48 @@
+package simulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Timeline is the sequence of changes to apply while simulating
+type Timeline struct {
+	Steps []Step `json:"steps"`
+}
+
+// Step is a change to the simulated cluster at a point in time
+// - all node names refer to nodes in the snapshot
+type Step struct {
+	// At is the offset from the start of the simulation
+	At metav1.Duration `json:"at"`
+	// NotReady nodes stop posting status (the Ready condition becomes Unknown)
+	NotReady []string `json:"notReady,omitempty"`
+	// Ready nodes post a Ready status again
+	Ready []string `json:"ready,omitempty"`
+	// Down nodes stop answering probes from every reporter
+	Down []string `json:"down,omitempty"`
+	// Up nodes answer probes again
+	Up []string `json:"up,omitempty"`
+	// Partitions sets the nodes a reporter alone cannot reach (replacing any previous set)
+	Partitions map[string][]string `json:"partitions,omitempty"`
+}
+
+// LoadTimeline reads a timeline from a YAML or JSON file
+func LoadTimeline(path string) (*Timeline, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading timeline %s: %s", path, err)
+	}
+	t := &Timeline{}
+	if err := yaml.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("error decoding timeline %s: %s", path, err)
+	}
+	sort.SliceStable(t.Steps, func(i, j int) bool {
+		return t.Steps[i].At.Duration < t.Steps[j].At.Duration
+	})
+	return t, nil
+}
@@ -0,0 +1,116 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	archiveMetadata          = "metadata.json"
+	archiveNodes             = "nodes.json"
+	archivePods              = "pods.json"
+	archiveReports           = "reports.json"
+	archiveNodeSnapshots     = "node-snapshots.json"
+	archiveVolumeAttachments = "volumeattachments.json"
+	archiveLeases            = "leases.json"
+)
+
+// metadata is written first in every archive
+type metadata struct {
+	CapturedAt time.Time `json:"capturedAt"`
+	Namespace  string    `json:"namespace"`
+}
+
+// WriteArchive writes the snapshot as a gzipped tar with a json file per kind
+func (s *Snapshot) WriteArchive(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{archiveMetadata, metadata{CapturedAt: s.CapturedAt, Namespace: s.Namespace}},
+		{archiveNodes, s.Nodes},
+		{archivePods, s.Pods},
+		{archiveReports, s.Reports},
+		{archiveNodeSnapshots, s.NodeSnapshots},
+		{archiveVolumeAttachments, s.VolumeAttachments},
+		{archiveLeases, s.Leases},
+	}
+	for _, f := range files {
+		data, err := json.MarshalIndent(f.data, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding %s: %s", f.name, err)
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    f.name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: s.CapturedAt,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadArchive reads a snapshot written by WriteArchive
+func ReadArchive(r io.Reader) (*Snapshot, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{}
+	targets := map[string]interface{}{
+		archiveNodes:             &s.Nodes,
+		archivePods:              &s.Pods,
+		archiveReports:           &s.Reports,
+		archiveNodeSnapshots:     &s.NodeSnapshots,
+		archiveVolumeAttachments: &s.VolumeAttachments,
+		archiveLeases:            &s.Leases,
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == archiveMetadata {
+			m := metadata{}
+			if err := json.Unmarshal(data, &m); err != nil {
+				return nil, fmt.Errorf("error decoding %s: %s", hdr.Name, err)
+			}
+			s.CapturedAt = m.CapturedAt
+			s.Namespace = m.Namespace
+			continue
+		}
+		target, ok := targets[hdr.Name]
+		if !ok {
+			// allow for files from newer versions
+			continue
+		}
+		if err := json.Unmarshal(data, target); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %s", hdr.Name, err)
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,142 @@
+package snapshot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	redacted          = "REDACTED"
+	lastAppliedConfig = "kubectl.kubernetes.io/last-applied-configuration"
+	mirrorPod         = "kubernetes.io/config.mirror"
+)
+
+// Capture reads everything needed to replay an incident from the cluster
+// - only pods on NotReady nodes are captured unless allPods is set
+// - values that may hold secrets are scrubbed
+// - reports are read from reportNamespace and node snapshots from namespace
+func Capture(c clientset.Interface, namespace, reportNamespace string, allPods bool) (*Snapshot, error) {
+	s := &Snapshot{
+		CapturedAt: time.Now(),
+		Namespace:  namespace,
+	}
+
+	nodes, err := c.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("can't list nodes: %s", err)
+	}
+	s.Nodes = nodes.Items
+	notReady := make(map[string]bool)
+	for i := range s.Nodes {
+		if !kubeutils.IsNodeReady(&s.Nodes[i]) {
+			notReady[s.Nodes[i].Name] = true
+		}
+	}
+
+	pods, err := c.CoreV1().Pods("").List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("can't list pods: %s", err)
+	}
+	for _, pod := range pods.Items {
+		if allPods || notReady[pod.Spec.NodeName] {
+			s.Pods = append(s.Pods, scrubPod(pod))
+		}
+	}
+
+	reports, err := c.CoreV1().ConfigMaps(reportNamespace).List(metav1.ListOptions{
+		LabelSelector: kubeutils.ReportSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't list reports: %s", err)
+	}
+	s.Reports = reports.Items
+
+	nodeSnapshots, err := c.CoreV1().ConfigMaps(namespace).List(metav1.ListOptions{
+		LabelSelector: kubeutils.NodeSnapshotSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't list node snapshots: %s", err)
+	}
+	s.NodeSnapshots = nodeSnapshots.Items
+
+	// The following are not available on every cluster - capture what we can
+	attachments, err := c.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("not capturing volume attachments: %s", err)
+	} else {
+		s.VolumeAttachments = attachments.Items
+	}
+	leases, err := c.CoordinationV1beta1().Leases(kubeutils.NodeLeaseNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("not capturing node leases: %s", err)
+	} else {
+		s.Leases = leases.Items
+	}
+	return s, nil
+}
+
+// scrubPod removes anything that may hold a secret
+// - literal environment values, container commands and args
+// - annotation values, except ours and the mirror pod annotation the reaper
+// relies on (the last applied configuration is removed)
+func scrubPod(pod v1.Pod) v1.Pod {
+	pod = *pod.DeepCopy()
+	delete(pod.Annotations, lastAppliedConfig)
+	for name := range pod.Annotations {
+		if name != mirrorPod && !strings.HasPrefix(name, kubeutils.AnnotationPrefix) {
+			pod.Annotations[name] = redacted
+		}
+	}
+	for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			for j := range containers[i].Env {
+				if containers[i].Env[j].Value != "" {
+					containers[i].Env[j].Value = redacted
+				}
+			}
+			scrubStrings(containers[i].Command)
+			scrubStrings(containers[i].Args)
+			// Probe and hook commands often carry credentials too (there is no
+			// startupProbe in this version of the api)
+			if probe := containers[i].LivenessProbe; probe != nil {
+				scrubHandler(&probe.Handler)
+			}
+			if probe := containers[i].ReadinessProbe; probe != nil {
+				scrubHandler(&probe.Handler)
+			}
+			if lifecycle := containers[i].Lifecycle; lifecycle != nil {
+				scrubHandler(lifecycle.PostStart)
+				scrubHandler(lifecycle.PreStop)
+			}
+		}
+	}
+	return pod
+}
+
+// scrubHandler redacts the command of an exec handler and the headers of an http one
+func scrubHandler(h *v1.Handler) {
+	if h == nil {
+		return
+	}
+	if h.Exec != nil {
+		scrubStrings(h.Exec.Command)
+	}
+	if h.HTTPGet != nil {
+		for i := range h.HTTPGet.HTTPHeaders {
+			h.HTTPGet.HTTPHeaders[i].Value = redacted
+		}
+	}
+}
+
+func scrubStrings(values []string) {
+	for i := range values {
+		values[i] = redacted
+	}
+}
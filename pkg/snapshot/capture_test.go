@@ -0,0 +1,83 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/appvia/metal-pod-reaper/pkg/kubeutils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const secret = "hunter2"
+
+func TestScrubPod(t *testing.T) {
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "db-0",
+			Annotations: map[string]string{
+				lastAppliedConfig:            `{"password":"` + secret + `"}`,
+				"example.com/token":          secret,
+				mirrorPod:                    "abc",
+				kubeutils.AnnotationReapedAt: "2020-01-01T12:00:00Z",
+			},
+		},
+		Spec: v1.PodSpec{
+			InitContainers: []v1.Container{{
+				Name:    "init",
+				Command: []string{"sh", "-c", "login --password=" + secret},
+				Lifecycle: &v1.Lifecycle{
+					PostStart: &v1.Handler{Exec: &v1.ExecAction{Command: []string{"notify", "--token", secret}}},
+				},
+			}},
+			Containers: []v1.Container{{
+				Name: "db",
+				Args: []string{"--password", secret},
+				LivenessProbe: &v1.Probe{Handler: v1.Handler{
+					Exec: &v1.ExecAction{Command: []string{"psql", "postgres://admin:" + secret + "@localhost"}},
+				}},
+				ReadinessProbe: &v1.Probe{Handler: v1.Handler{
+					HTTPGet: &v1.HTTPGetAction{
+						Path:        "/healthz",
+						HTTPHeaders: []v1.HTTPHeader{{Name: "Authorization", Value: "Bearer " + secret}},
+					},
+				}},
+				Lifecycle: &v1.Lifecycle{
+					PreStop: &v1.Handler{Exec: &v1.ExecAction{Command: []string{"drain", "--password=" + secret}}},
+				},
+				Env: []v1.EnvVar{
+					{Name: "PASSWORD", Value: secret},
+					{Name: "FROM_SECRET", ValueFrom: &v1.EnvVarSource{}},
+				},
+			}},
+		},
+	}
+	scrubbed := scrubPod(pod)
+
+	b, err := yaml.Marshal(scrubbed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), secret) {
+		t.Errorf("expected the secret to be scrubbed, got:\n%s", b)
+	}
+	if _, ok := scrubbed.Annotations[lastAppliedConfig]; ok {
+		t.Error("expected the last applied configuration to be removed")
+	}
+	if scrubbed.Annotations[mirrorPod] != "abc" {
+		t.Errorf("expected the mirror pod annotation to be kept, got %q", scrubbed.Annotations[mirrorPod])
+	}
+	if scrubbed.Annotations[kubeutils.AnnotationReapedAt] != "2020-01-01T12:00:00Z" {
+		t.Errorf("expected our annotations to be kept, got %q", scrubbed.Annotations[kubeutils.AnnotationReapedAt])
+	}
+	if scrubbed.Spec.Containers[0].Env[1].ValueFrom == nil {
+		t.Error("expected env from a secret to be kept")
+	}
+	if scrubbed.Spec.Containers[0].ReadinessProbe.HTTPGet.Path != "/healthz" {
+		t.Error("expected the probe path to be kept")
+	}
+	if pod.Spec.Containers[0].Args[1] != secret || pod.Spec.Containers[0].LivenessProbe.Exec.Command[1] == redacted {
+		t.Error("expected the original pod not to be changed")
+	}
+}
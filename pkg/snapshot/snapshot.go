@@ -0,0 +1,60 @@
+// Package snapshot records the cluster state that mpodr makes decisions on
+// so that it can be replayed (e.g. by the simulator) without cluster access
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Snapshot is a point in time copy of the nodes, pods and reachability reports
+type Snapshot struct {
+	CapturedAt        time.Time                    `json:"capturedAt"`
+	Namespace         string                       `json:"namespace,omitempty"`
+	Nodes             []v1.Node                    `json:"nodes"`
+	Pods              []v1.Pod                     `json:"pods"`
+	Reports           []v1.ConfigMap               `json:"reports"`
+	NodeSnapshots     []v1.ConfigMap               `json:"nodeSnapshots,omitempty"`
+	VolumeAttachments []storagev1.VolumeAttachment `json:"volumeAttachments,omitempty"`
+	Leases            []coordinationv1beta1.Lease  `json:"leases,omitempty"`
+}
+
+// Load reads a snapshot from a YAML or JSON file or an archive written by WriteArchive
+func Load(path string) (*Snapshot, error) {
+	if isArchive(path) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading snapshot %s: %s", path, err)
+		}
+		defer f.Close()
+		s, err := ReadArchive(f)
+		if err != nil {
+			return nil, fmt.Errorf("error reading snapshot %s: %s", path, err)
+		}
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot %s: %s", path, err)
+	}
+	s := &Snapshot{}
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("error decoding snapshot %s: %s", path, err)
+	}
+	if s.CapturedAt.IsZero() {
+		s.CapturedAt = time.Now()
+	}
+	return s, nil
+}
+
+func isArchive(path string) bool {
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}